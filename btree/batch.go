@@ -0,0 +1,82 @@
+package btree
+
+import "bytes"
+
+const (
+	batchPut = iota
+	batchDel
+	batchDelRange
+)
+
+type batchOp struct {
+	kind uint8
+	key  []byte
+	val  []byte // the value of a put, the end of a range delete
+}
+
+// WriteBatch collects writes in memory for KV.Apply, which applies them in
+// the order they were added. The batch keeps its own copies of the keys
+// and values, so the caller may reuse its buffers.
+type WriteBatch struct {
+	ops []batchOp
+}
+
+func (b *WriteBatch) Put(key []byte, val []byte) {
+	b.ops = append(b.ops, batchOp{kind: batchPut, key: bytes.Clone(key), val: bytes.Clone(val)})
+}
+
+func (b *WriteBatch) Delete(key []byte) {
+	b.ops = append(b.ops, batchOp{kind: batchDel, key: bytes.Clone(key)})
+}
+
+// DeleteRange deletes the keys in [start, end); a nil bound is open.
+func (b *WriteBatch) DeleteRange(start []byte, end []byte) {
+	b.ops = append(b.ops, batchOp{kind: batchDelRange, key: bytes.Clone(start), val: bytes.Clone(end)})
+}
+
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+func (b *WriteBatch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// Apply writes the whole batch with one commit. If any write fails, none
+// of them is applied.
+func (db *KV) Apply(b *WriteBatch) error {
+	if db.ReadOnly {
+		return ErrReadOnly
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+	cc := getCC(db)
+	cc.wmu.Lock()
+	db.writeBegin()
+	meta := saveMeta(db)
+	if err := db.tree.apply(b); err != nil {
+		revertMeta(db, meta)
+		cc.wmu.Unlock()
+		return err
+	}
+	return commitWrite(db, meta, cc.wmu.Unlock)
+}
+
+func (tree *BTree) apply(b *WriteBatch) error {
+	for _, op := range b.ops {
+		var err error
+		switch op.kind {
+		case batchPut:
+			err = tree.Insert(op.key, op.val)
+		case batchDel:
+			_, err = tree.Delete(op.key)
+		case batchDelRange:
+			_, err = tree.DeleteRange(op.key, op.val)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestApplyBatch(t *testing.T) {
+	kv := KV{WAL: true}
+	openKV(t, &kv)
+	defer kv.Close()
+	model := map[string]string{}
+	var b WriteBatch
+	key := []byte("k")
+	for i := 0; i < 1000; i++ {
+		k := fmt.Sprintf("k%04d", i)
+		// the batch keeps its own copy
+		key = append(key[:0], k...)
+		b.Put(key, key)
+		model[k] = k
+	}
+	b.DeleteRange([]byte("k0100"), []byte("k0200"))
+	for i := 100; i < 200; i++ {
+		delete(model, fmt.Sprintf("k%04d", i))
+	}
+	// later operations apply on top of earlier ones
+	b.Put([]byte("k0150"), []byte("again"))
+	model["k0150"] = "again"
+	b.Delete([]byte("k0999"))
+	delete(model, "k0999")
+	b.DeleteRange([]byte("k0990"), nil)
+	for i := 990; i < 999; i++ {
+		delete(model, fmt.Sprintf("k%04d", i))
+	}
+	seq := kv.seq
+	if err := kv.Apply(&b); err != nil {
+		t.Fatal(err)
+	}
+	if kv.seq != seq+1 {
+		t.Fatalf("the batch took %d commits", kv.seq-seq)
+	}
+	checkModel(t, &kv, model)
+	kv.Close()
+	openKV(t, &kv)
+	checkModel(t, &kv, model)
+}
+
+func TestFailedBatchChangesNothing(t *testing.T) {
+	kv := KV{}
+	openKV(t, &kv)
+	defer kv.Close()
+	model := fillKV(t, &kv, 1000)
+	seq := kv.seq
+	var b WriteBatch
+	b.Put([]byte("new"), []byte("x"))
+	b.DeleteRange(nil, testKey(500))
+	b.Put(bytes.Repeat([]byte("z"), maxKeySize(kv.page.size)+1), nil)
+	if err := kv.Apply(&b); err == nil {
+		t.Fatal("a batch with an oversized key was applied")
+	}
+	if kv.seq != seq {
+		t.Fatal("the failed batch was committed")
+	}
+	checkTree(t, &kv.tree)
+	checkModel(t, &kv, model)
+
+	// a reset batch starts empty
+	b.Reset()
+	b.Put([]byte("new"), []byte("x"))
+	if err := kv.Apply(&b); err != nil {
+		t.Fatal(err)
+	}
+	model["new"] = "x"
+	checkModel(t, &kv, model)
+}
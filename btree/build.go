@@ -3,18 +3,40 @@ package btree
 import "encoding/binary"
 
 func nodeAppendKV(new BNode, idx uint16, ptr uint64, key []byte, val []byte) {
+	nodeAppendCell(new, idx, ptr, key, val, 0)
+}
+
+func nodeAppendCell(new BNode, idx uint16, ptr uint64, key []byte, val []byte, flags uint16) {
+	prefix := new.getPrefix()
+	assert(len(key) >= len(prefix))
+	nodeAppendSuffix(new, idx, ptr, key[len(prefix):], nil, val, flags)
+}
+
+// nodeAppendSuffix stores a key that is already stripped of the node
+// prefix, given in two parts so that re-encoding needs no copy.
+func nodeAppendSuffix(new BNode, idx uint16, ptr uint64, head []byte, tail []byte, val []byte, flags uint16) {
+	klen := uint16(len(head) + len(tail))
 	new.setPtr(idx, ptr)
 	pos := new.kvPos(idx)
-	binary.LittleEndian.PutUint16(new[pos+0:], uint16(len(key)))
-	binary.LittleEndian.PutUint16(new[pos+2:], uint16(len(val)))
-	copy(new[pos+4:], key)
-	copy(new[pos+4+uint16(len(key)):], val)
-	new.setOffset(idx+1, new.getOffset(idx)+4+uint16(len(key)+len(val)))
+	binary.LittleEndian.PutUint16(new[pos+0:], klen)
+	binary.LittleEndian.PutUint16(new[pos+2:], uint16(len(val))|flags)
+	copy(new[pos+4:], head)
+	copy(new[pos+4+uint16(len(head)):], tail)
+	copy(new[pos+4+klen:], val)
+	new.setOffset(idx+1, new.getOffset(idx)+4+klen+uint16(len(val)))
 }
 
 func nodeAppendRange(new BNode, old BNode, dstNew uint16, srcOld uint16, n uint16) {
+	np, op := new.getPrefix(), old.getPrefix()
 	for i := uint16(0); i < n; i++ {
 		dst, src := dstNew+i, srcOld+i
-		nodeAppendKV(new, dst, old.getPtr(src), old.getKey(src), old.getVal(src))
+		suffix := old.getSuffix(src)
+		var head []byte
+		if len(np) <= len(op) {
+			head = op[len(np):]
+		} else {
+			suffix = suffix[len(np)-len(op):]
+		}
+		nodeAppendSuffix(new, dst, old.getPtr(src), head, suffix, old.getVal(src), old.getFlags(src))
 	}
 }
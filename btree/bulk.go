@@ -0,0 +1,253 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// BULK_LOAD_FILL is how full BulkLoad packs the nodes it writes, leaving
+// room for later inserts before a node has to split.
+const BULK_LOAD_FILL = 0.9
+
+var (
+	ErrBulkUnsorted = errors.New("bulk load: keys are not in ascending order")
+	ErrBulkOverlap  = errors.New("bulk load: keys overlap existing keys")
+)
+
+// BulkSource returns the pairs to load one at a time, in ascending key
+// order, and ok false once it is exhausted.
+type BulkSource func() (key []byte, val []byte, ok bool)
+
+// bulkLevel collects the cells of the node being packed on one level.
+type bulkLevel struct {
+	btype   uint16
+	keys    [][]byte
+	vals    [][]byte
+	ptrs    []uint64
+	flags   []uint16
+	bytes   int
+	last    []byte
+	emitted bool
+}
+
+// bulkLoader builds the tree bottom-up: each level fills a node until the
+// next cell would push it past the fill target, writes it, and hands its
+// first key, pointer and key count to the level above.
+type bulkLoader struct {
+	tree   *BTree
+	limit  int
+	levels []*bulkLevel
+}
+
+// BulkLoad inserts a sorted stream of pairs, writing each new page once.
+// The tree may be empty or hold keys outside the range of the input: the
+// nodes on the path to the first input key are rebuilt around the new
+// leaves and every other subtree is kept as it is. Input that is not in
+// ascending order fails with ErrBulkUnsorted and input that interleaves
+// with keys already in the tree with ErrBulkOverlap; the tree is then
+// unchanged, though pages may have been allocated, so the transaction
+// should be rolled back.
+func (tree *BTree) BulkLoad(src BulkSource) error {
+	key, val, ok := src()
+	if !ok {
+		return nil
+	}
+	l := &bulkLoader{tree: tree, limit: int(BULK_LOAD_FILL * float64(nodeCap(tree.pageSize)))}
+	path, err := l.descend(key)
+	if err != nil {
+		return err
+	}
+	if len(path) == 0 {
+		l.level(0)
+		// the leftmost leaf starts with the empty key
+		if err := l.add(0, []byte{}, nil, 0, 0); err != nil {
+			return err
+		}
+	}
+	var prev []byte
+	for ok {
+		if prev != nil && bytes.Compare(key, prev) <= 0 {
+			return ErrBulkUnsorted
+		}
+		if err := tree.checkLimit(key, val); err != nil {
+			return err
+		}
+		put := val
+		var flags uint16
+		if len(val) > maxValSize(tree.pageSize) {
+			if val, err = overflowWrite(tree, val); err != nil {
+				return err
+			}
+			flags = VAL_OVERFLOW
+		}
+		if err := l.add(0, key, val, 0, flags); err != nil {
+			return err
+		}
+		tree.changed(EVENT_PUT, key, put)
+		prev = l.levels[0].last
+		key, val, ok = src()
+	}
+	root, err := l.finish(path, prev)
+	if err != nil {
+		return err
+	}
+	for _, p := range path {
+		if err := tree.del(p.ptr); err != nil {
+			return err
+		}
+	}
+	tree.root = root
+	return nil
+}
+
+// descend finds the nodes on the path to key, leaf first, and queues on
+// each level the cells that come before the path.
+func (l *bulkLoader) descend(key []byte) ([]iterFrame, error) {
+	var path []iterFrame
+	for ptr := l.tree.root; ptr != 0; {
+		node, err := l.tree.node(ptr)
+		if err != nil {
+			return nil, err
+		}
+		idx := nodeLookupLE(node, key)
+		path = append(path, iterFrame{ptr: ptr, idx: int(idx)})
+		if node.btype() == BNODE_LEAF_TYPE {
+			if node.cmpKey(idx, key) == 0 {
+				return nil, ErrBulkOverlap
+			}
+			break
+		}
+		ptr = node.getPtr(idx)
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	for i, p := range path {
+		node, err := l.tree.node(p.ptr)
+		if err != nil {
+			return nil, err
+		}
+		l.level(i).btype = node.btype()
+		n := uint16(p.idx)
+		if node.btype() == BNODE_LEAF_TYPE {
+			n++
+		}
+		for j := uint16(0); j < n; j++ {
+			if err := l.add(i, node.getKey(j), node.getVal(j), node.getPtr(j), node.getFlags(j)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return path, nil
+}
+
+// finish queues the cells after the path, which must all sort after the
+// last input key, and closes the levels from the bottom up.
+func (l *bulkLoader) finish(path []iterFrame, last []byte) (uint64, error) {
+	for i := 0; i < len(l.levels); i++ {
+		if i < len(path) {
+			node, err := l.tree.node(path[i].ptr)
+			if err != nil {
+				return 0, err
+			}
+			first := uint16(path[i].idx + 1)
+			if first < node.nkeys() && node.cmpKey(first, last) <= 0 {
+				return 0, ErrBulkOverlap
+			}
+			for j := first; j < node.nkeys(); j++ {
+				if err := l.add(i, node.getKey(j), node.getVal(j), node.getPtr(j), node.getFlags(j)); err != nil {
+					return 0, err
+				}
+			}
+		}
+		lv := l.levels[i]
+		if i == len(l.levels)-1 && !lv.emitted {
+			if lv.btype == BNODE_NODE_TYPE && len(lv.keys) == 1 {
+				return lv.ptrs[0], nil
+			}
+			return l.write(lv)
+		}
+		if len(lv.keys) > 0 {
+			if err := l.emit(i); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return 0, nil
+}
+
+func (l *bulkLoader) level(i int) *bulkLevel {
+	if i == len(l.levels) {
+		l.levels = append(l.levels, &bulkLevel{btype: BNODE_NODE_TYPE})
+		if i == 0 {
+			l.levels[0].btype = BNODE_LEAF_TYPE
+		}
+	}
+	return l.levels[i]
+}
+
+func (l *bulkLoader) add(i int, key []byte, val []byte, ptr uint64, flags uint16) error {
+	lv := l.level(i)
+	if lv.last != nil && bytes.Compare(key, lv.last) <= 0 {
+		return ErrBulkOverlap
+	}
+	if len(lv.keys) > 0 && l.size(lv, key, val) > l.limit {
+		if err := l.emit(i); err != nil {
+			return err
+		}
+	}
+	key = append([]byte{}, key...)
+	lv.keys = append(lv.keys, key)
+	lv.vals = append(lv.vals, append([]byte(nil), val...))
+	lv.ptrs = append(lv.ptrs, ptr)
+	lv.flags = append(lv.flags, flags)
+	lv.bytes += len(key) + len(val)
+	lv.last = key
+	return nil
+}
+
+// size is the size of the node on lv once key and val are added.
+func (l *bulkLoader) size(lv *bulkLevel, key []byte, val []byte) int {
+	n := len(lv.keys) + 1
+	prefix := nodePrefix(lv.keys[0], key, uint16(n), l.tree.pageSize)
+	size := 4 + 14*n + int(prefixArea(len(prefix))) + lv.bytes + len(key) + len(val)
+	return size - n*len(prefix)
+}
+
+func (l *bulkLoader) emit(i int) error {
+	lv := l.levels[i]
+	first, count := lv.keys[0], lv.count()
+	ptr, err := l.write(lv)
+	if err != nil {
+		return err
+	}
+	lv.emitted = true
+	return l.add(i+1, first, countVal(count), ptr, 0)
+}
+
+// count is the number of keys under the pending cells of lv.
+func (lv *bulkLevel) count() uint64 {
+	if lv.btype == BNODE_LEAF_TYPE {
+		return uint64(len(lv.keys))
+	}
+	var n uint64
+	for _, val := range lv.vals {
+		n += binary.LittleEndian.Uint64(val)
+	}
+	return n
+}
+
+// write stores the pending cells of lv as a node and empties the level.
+func (l *bulkLoader) write(lv *bulkLevel) (uint64, error) {
+	n := uint16(len(lv.keys))
+	node := BNode(make([]byte, l.tree.pageSize))
+	node.setHeader(lv.btype, n)
+	node.setPrefix(nodePrefix(lv.keys[0], lv.keys[n-1], n, l.tree.pageSize))
+	for i := uint16(0); i < n; i++ {
+		nodeAppendCell(node, i, lv.ptrs[i], lv.keys[i], lv.vals[i], lv.flags[i])
+	}
+	lv.keys, lv.vals, lv.ptrs, lv.flags = lv.keys[:0], lv.vals[:0], lv.ptrs[:0], lv.flags[:0]
+	lv.bytes = 0
+	return l.tree.new(node)
+}
@@ -0,0 +1,160 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// sliceSource streams keys, which must be sorted, with their values in
+// model.
+func sliceSource(keys []string, model map[string]string) BulkSource {
+	i := 0
+	return func() ([]byte, []byte, bool) {
+		if i == len(keys) {
+			return nil, nil, false
+		}
+		k := keys[i]
+		i++
+		return []byte(k), []byte(model[k]), true
+	}
+}
+
+// bulkKeys adds n keys made with format to model and returns them sorted.
+func bulkKeys(model map[string]string, format string, n int, val string) []string {
+	keys := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		k := fmt.Sprintf(format, i)
+		keys = append(keys, k)
+		model[k] = val
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestBulkLoad(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compress=%v", compress), func(t *testing.T) {
+			kv := KV{Compress: compress}
+			openKV(t, &kv)
+			defer kv.Close()
+			r := rand.New(rand.NewSource(1))
+			model := map[string]string{}
+			var keys []string
+			for i := 0; i < 10000; i++ {
+				k := fmt.Sprintf("b%07d", i*3)
+				v := fmt.Sprint(i)
+				if r.Intn(500) == 0 {
+					v = string(bytes.Repeat([]byte("L"), 5000+r.Intn(20000)))
+				}
+				model[k] = v
+				keys = append(keys, k)
+			}
+			if err := kv.BulkLoad(sliceSource(keys, model)); err != nil {
+				t.Fatal(err)
+			}
+			checkTree(t, &kv.tree)
+			checkModel(t, &kv, model)
+
+			// before, between and after the keys loaded so far
+			for _, g := range [][2]string{{"a", "a%06d"}, {"m", "b0015001%04d"}, {"z", "z%06d"}} {
+				if err := kv.BulkLoad(sliceSource(bulkKeys(model, g[1], 2000, g[0]), model)); err != nil {
+					t.Fatal(err)
+				}
+				checkTree(t, &kv.tree)
+				checkModel(t, &kv, model)
+			}
+
+			// the tree takes ordinary writes afterwards
+			for i := 0; i < 1000; i++ {
+				k := fmt.Sprintf("b%07d", r.Intn(30000))
+				if r.Intn(2) == 0 {
+					if err := kv.Set([]byte(k), []byte("n")); err != nil {
+						t.Fatal(err)
+					}
+					model[k] = "n"
+				} else {
+					if _, err := kv.Del([]byte(k)); err != nil {
+						t.Fatal(err)
+					}
+					delete(model, k)
+				}
+			}
+			checkTree(t, &kv.tree)
+			kv.Close()
+			openKV(t, &kv)
+			checkModel(t, &kv, model)
+		})
+	}
+}
+
+func TestBulkLoadRejectsBadInput(t *testing.T) {
+	kv := KV{}
+	openKV(t, &kv)
+	defer kv.Close()
+	model := map[string]string{}
+	keys := bulkKeys(model, "b%05d0", 1000, "v")
+	if err := kv.BulkLoad(sliceSource(keys, model)); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		keys []string
+		want error
+	}{
+		{[]string{"c1", "c3", "c2"}, ErrBulkUnsorted},
+		{[]string{"c1", "c1"}, ErrBulkUnsorted},
+		// lands on a key already there
+		{[]string{"b000010", "b000011"}, ErrBulkOverlap},
+		// straddles one
+		{[]string{"b000011", "b000025"}, ErrBulkOverlap},
+	}
+	for _, c := range cases {
+		bad := map[string]string{}
+		for _, k := range c.keys {
+			bad[k] = "x"
+		}
+		if err := kv.BulkLoad(sliceSource(c.keys, bad)); !errors.Is(err, c.want) {
+			t.Errorf("%q: %v, want %v", c.keys, err, c.want)
+		}
+	}
+	checkTree(t, &kv.tree)
+	checkModel(t, &kv, model)
+}
+
+// Packed bottom-up, the tree takes far fewer pages than the same keys
+// inserted one by one.
+func TestBulkLoadPacksPages(t *testing.T) {
+	var pages [2]uint64
+	for i, bulk := range []bool{false, true} {
+		kv := KV{}
+		openKV(t, &kv)
+		model := map[string]string{}
+		keys := bulkKeys(model, "k%06d", 8000, "value")
+		if bulk {
+			if err := kv.BulkLoad(sliceSource(keys, model)); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			tx, err := kv.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, k := range keys {
+				if err := tx.Set([]byte(k), []byte(model[k])); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		pages[i] = kv.page.flushed
+		kv.Close()
+	}
+	if pages[1]*2 > pages[0] {
+		t.Fatalf("bulk load took %d pages, inserts %d", pages[1], pages[0])
+	}
+}
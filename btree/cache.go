@@ -0,0 +1,109 @@
+package btree
+
+import (
+	"container/list"
+	"sync"
+)
+
+const DEFAULT_CACHE_PAGES = 4096
+
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Pages     int
+	Pinned    int
+}
+
+type cacheEntry struct {
+	ptr uint64
+	buf []byte
+}
+
+// pageCache is an LRU of clean page images. Pages pinned by an active
+// iterator stay resident even when the cache is over its limit.
+type pageCache struct {
+	mu    sync.Mutex
+	limit int
+	lru   *list.List
+	items map[uint64]*list.Element
+	pins  map[uint64]int
+	stats CacheStats
+}
+
+func newPageCache(limit int) *pageCache {
+	if limit <= 0 {
+		limit = DEFAULT_CACHE_PAGES
+	}
+	return &pageCache{
+		limit: limit,
+		lru:   list.New(),
+		items: make(map[uint64]*list.Element),
+		pins:  make(map[uint64]int),
+	}
+}
+
+func (c *pageCache) get(ptr uint64) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[ptr]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry).buf, true
+}
+
+func (c *pageCache) put(ptr uint64, buf []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[ptr]; ok {
+		e.Value.(*cacheEntry).buf = buf
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.items[ptr] = c.lru.PushFront(&cacheEntry{ptr: ptr, buf: buf})
+	c.evict()
+}
+
+func (c *pageCache) evict() {
+	e := c.lru.Back()
+	for len(c.items) > c.limit && e != nil {
+		prev := e.Prev()
+		ent := e.Value.(*cacheEntry)
+		if c.pins[ent.ptr] == 0 {
+			c.lru.Remove(e)
+			delete(c.items, ent.ptr)
+			c.stats.Evictions++
+		}
+		e = prev
+	}
+}
+
+func (c *pageCache) pin(ptr uint64) {
+	c.mu.Lock()
+	c.pins[ptr]++
+	c.mu.Unlock()
+}
+
+func (c *pageCache) unpin(ptr uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pins[ptr] <= 1 {
+		delete(c.pins, ptr)
+		c.evict()
+		return
+	}
+	c.pins[ptr]--
+}
+
+func (c *pageCache) snapshot() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Pages = len(c.items)
+	s.Pinned = len(c.pins)
+	return s
+}
@@ -0,0 +1,74 @@
+package btree
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPageCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newPageCache(2)
+	c.put(1, []byte{1})
+	c.put(2, []byte{2})
+	if _, ok := c.get(1); !ok {
+		t.Fatal("page 1 missing")
+	}
+	c.put(3, []byte{3})
+	if _, ok := c.get(2); ok {
+		t.Fatal("page 2 was used last and should have gone")
+	}
+	for _, ptr := range []uint64{1, 3} {
+		if _, ok := c.get(ptr); !ok {
+			t.Fatalf("page %d missing", ptr)
+		}
+	}
+	s := c.snapshot()
+	if s.Pages != 2 || s.Evictions != 1 || s.Hits != 3 || s.Misses != 1 {
+		t.Fatalf("stats %+v", s)
+	}
+}
+
+func TestPageCacheKeepsPinnedPages(t *testing.T) {
+	c := newPageCache(1)
+	c.put(1, []byte{1})
+	c.pin(1)
+	c.put(2, []byte{2})
+	if _, ok := c.get(1); !ok {
+		t.Fatal("pinned page evicted")
+	}
+	if s := c.snapshot(); s.Pages != 1 || s.Pinned != 1 {
+		t.Fatalf("stats %+v", s)
+	}
+	c.unpin(1)
+	if s := c.snapshot(); s.Pages != 1 || s.Pinned != 0 {
+		t.Fatalf("unpinned page kept over the limit: %+v", s)
+	}
+}
+
+func TestKVCacheStaysBounded(t *testing.T) {
+	kv := KV{CachePages: 16}
+	openKV(t, &kv)
+	defer kv.Close()
+	val := bytes.Repeat([]byte("v"), 100)
+	for i := 0; i < 2000; i++ {
+		if err := kv.Set(testKey(i), val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for pass := 0; pass < 2; pass++ {
+		n := 0
+		err := kv.Scan(nil, nil, func(k, v []byte) bool {
+			n++
+			return bytes.Equal(v, val)
+		})
+		if err != nil || n != 2000 {
+			t.Fatal("scan", n, err)
+		}
+	}
+	s := kv.CacheStats()
+	if s.Pages > 16 || s.Pinned != 0 {
+		t.Fatalf("cache over its limit: %+v", s)
+	}
+	if s.Hits == 0 || s.Evictions == 0 {
+		t.Fatalf("cache not used: %+v", s)
+	}
+}
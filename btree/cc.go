@@ -18,6 +18,7 @@ type dbCC struct {
 	readers map[uint64]uint64
 	nextID  uint64
 	seqFn   func(*KV) uint64
+	group   commitGroup
 }
 
 var ccState sync.Map
@@ -36,11 +37,18 @@ func (db *KV) RegisterFreeSeqProvider(fn func(*KV) uint64) {
 	getCC(db).seqFn = fn
 }
 
-func (db *KV) BeginWrite() *Tx {
+func (db *KV) BeginWrite() (*Tx, error) {
+	if db.ReadOnly {
+		return nil, ErrReadOnly
+	}
 	getCC(db).wmu.Lock()
-	tx := db.Begin()
+	tx, err := db.Begin()
+	if err != nil {
+		getCC(db).wmu.Unlock()
+		return nil, err
+	}
 	tx.release = func() { getCC(db).wmu.Unlock() }
-	return tx
+	return tx, nil
 }
 
 func (db *KV) BeginRead() *readGuard {
@@ -0,0 +1,54 @@
+package btree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+var ErrCorruptPage = errors.New("corrupt page")
+
+type PageError struct {
+	Page uint64
+	Err  error
+}
+
+func (e *PageError) Error() string {
+	return fmt.Sprintf("page %d: %v", e.Page, e.Err)
+}
+
+func (e *PageError) Unwrap() error {
+	return e.Err
+}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// The checksum trailer is the last 4 bytes of the page, whatever the
+// page size of the database.
+func pageChecksum(pg []byte) uint32 {
+	return crc32.Checksum(pg[:nodeCap(len(pg))], crcTable)
+}
+
+func pageSetChecksum(pg []byte) {
+	binary.LittleEndian.PutUint32(pg[nodeCap(len(pg)):], pageChecksum(pg))
+}
+
+// pageVerify checks the trailer of a page read from the file. Every page
+// is written before it is first read, so a zeroed one fails too.
+func pageVerify(ptr uint64, pg []byte) error {
+	sum := binary.LittleEndian.Uint32(pg[nodeCap(len(pg)):])
+	if sum != pageChecksum(pg) {
+		return &PageError{Page: ptr, Err: ErrCorruptPage}
+	}
+	return nil
+}
+
+func isZeroPage(pg []byte) bool {
+	for _, c := range pg {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package btree
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPageVerify(t *testing.T) {
+	for _, size := range PAGE_SIZES {
+		pg := make([]byte, size)
+		copy(pg, "some node")
+		pageSetChecksum(pg)
+		if err := pageVerify(7, pg); err != nil {
+			t.Fatal(size, err)
+		}
+		pg[size/2] ^= 1
+		err := pageVerify(7, pg)
+		var pe *PageError
+		if !errors.Is(err, ErrCorruptPage) || !errors.As(err, &pe) || pe.Page != 7 {
+			t.Fatal(size, "flipped bit accepted:", err)
+		}
+		if err := pageVerify(7, make([]byte, size)); !errors.Is(err, ErrCorruptPage) {
+			t.Fatal(size, "zeroed page accepted:", err)
+		}
+	}
+}
+
+// damage overwrites the file image of page ptr, from off on, with data.
+func damage(t *testing.T, kv *KV, ptr uint64, off int64, data []byte) {
+	t.Helper()
+	start, _ := kv.fileRange(ptr)
+	writeAt(t, kv, start+off, data)
+}
+
+func TestCorruptPageIsReported(t *testing.T) {
+	for _, zero := range []bool{false, true} {
+		var kv KV
+		openKV(t, &kv)
+		for i := 0; i < 300; i++ {
+			if err := kv.Set(testKey(i), make([]byte, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		root := kv.tree.root
+		kv.Close()
+		if zero {
+			damage(t, &kv, root, 0, make([]byte, kv.page.size))
+		} else {
+			damage(t, &kv, root, 100, []byte{0xAB})
+		}
+		openKV(t, &kv)
+		_, _, err := kv.Get(testKey(1))
+		var pe *PageError
+		if !errors.Is(err, ErrCorruptPage) || !errors.As(err, &pe) || pe.Page != root {
+			t.Fatal("get:", err)
+		}
+		if err := kv.Set(testKey(1), []byte("v")); !errors.Is(err, ErrCorruptPage) {
+			t.Fatal("set:", err)
+		}
+		kv.Close()
+	}
+}
+
+func TestNewDatabaseWritesEveryPageItReads(t *testing.T) {
+	var kv KV
+	openKV(t, &kv)
+	defer kv.Close()
+	_, head := kv.initLayout()
+	pg, err := kv.pageReadFile(head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isZeroPage(pg) {
+		t.Fatal("the first free list page was not written")
+	}
+	if err := kv.Set([]byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,262 @@
+package btree
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrCommitAborted = errors.New("commit aborted: an earlier commit failed to sync")
+
+type groupFail struct {
+	durable uint64
+	err     error
+}
+
+// commitGroup batches the fsyncs of concurrent committers. A commit writes
+// its pages while it holds the writer lock, then waits here; a waiter that
+// finds no sync in flight becomes the leader and makes every commit
+// prepared so far durable with one round of fsyncs.
+//
+// A failed sync starts a new epoch. Everything prepared in the old epoch
+// past its last durable commit gets the sync error, and the next writer
+// rolls the in-memory state back to the durable meta block.
+type commitGroup struct {
+	mu          sync.Mutex
+	cond        sync.Cond
+	syncing     bool
+	broken      bool
+	epoch       uint64
+	fails       []groupFail
+	prepared    uint64
+	meta        []byte
+	walSize     int64
+	durable     uint64
+	durableMeta []byte
+	durableWal  int64
+	slot        uint64
+	watch       *watchHub
+	events      []Event // of the commits prepared since the last sync
+}
+
+func (g *commitGroup) reset(meta []byte, slot uint64, walSize int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.cond.L = &g.mu
+	g.syncing = false
+	g.broken = false
+	g.epoch = 0
+	g.fails = nil
+	g.prepared = metaSeq(meta)
+	g.meta = meta
+	g.walSize = walSize
+	g.durable = metaSeq(meta)
+	g.durableMeta = meta
+	g.durableWal = walSize
+	g.slot = slot
+	g.events = nil
+}
+
+func (db *KV) group() *commitGroup {
+	return &getCC(db).group
+}
+
+// writeBegin runs before a write transaction touches the tree. Only pages
+// freed by durable commits before the oldest reader began may be reused,
+// whatever is still in flight; this bounds the free list's own nodes too.
+func (db *KV) writeBegin() {
+	g := db.group()
+	g.mu.Lock()
+	broken := g.broken
+	g.mu.Unlock()
+	if broken {
+		_ = repairCommit(db)
+	}
+	oldest := db.OldestActiveReaderSeq()
+	g.mu.Lock()
+	db.free.maxSeq = max(min(metaFreeTail(g.durableMeta), oldest), db.free.headSeq)
+	g.mu.Unlock()
+}
+
+// commitWrite commits a write made through the KV or a Tx, deleting a
+// batch of expired keys in the same commit.
+func commitWrite(db *KV, meta []byte, release func()) error {
+	if _, _, err := db.reap(TTL_REAP_BATCH); err != nil {
+		revertMeta(db, meta)
+		if release != nil {
+			release()
+		}
+		return err
+	}
+	return commitTx(db, meta, release)
+}
+
+func commitTx(db *KV, meta []byte, release func()) error {
+	seq, epoch, err := prepareCommit(db, meta)
+	if release != nil {
+		release()
+	}
+	if err != nil {
+		return err
+	}
+	if err := waitDurable(db, seq, epoch); err != nil {
+		return err
+	}
+	db.watchWait()
+	if db.WAL && db.walSize() >= WAL_CHECKPOINT_SIZE {
+		return db.Checkpoint()
+	}
+	return nil
+}
+
+func prepareCommit(db *KV, meta []byte) (uint64, uint64, error) {
+	g := db.group()
+	g.mu.Lock()
+	broken := g.broken
+	g.mu.Unlock()
+	if broken {
+		_ = repairCommit(db)
+		return 0, 0, ErrCommitAborted
+	}
+	var next []byte
+	err := db.extentFlush()
+	if err == nil && db.WAL {
+		next, err = walPrepare(db)
+	} else if err == nil {
+		next, err = filePrepare(db)
+	}
+	if err != nil {
+		revertMeta(db, meta)
+		if db.WAL {
+			_ = walUndo(db)
+		}
+		return 0, 0, err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.prepared = metaSeq(next)
+	g.meta = next
+	g.walSize = db.wal.size
+	for i := range db.changes {
+		db.changes[i].Seq = g.prepared
+	}
+	g.events = append(g.events, db.changes...)
+	db.changes = nil
+	return g.prepared, g.epoch, nil
+}
+
+func filePrepare(db *KV) ([]byte, error) {
+	if err := writePages(db); err != nil {
+		return nil, err
+	}
+	db.seq++
+	return saveMeta(db), nil
+}
+
+func waitDurable(db *KV, seq uint64, epoch uint64) error {
+	g := db.group()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for {
+		if g.epoch != epoch {
+			if f := g.fails[epoch]; seq > f.durable {
+				return f.err
+			}
+			return nil
+		}
+		if g.durable >= seq {
+			return nil
+		}
+		if g.syncing {
+			g.cond.Wait()
+			continue
+		}
+		g.syncing = true
+		target, meta, walSize, slot := g.prepared, g.meta, g.walSize, g.slot^1
+		g.mu.Unlock()
+		err := syncCommit(db, meta, slot)
+		g.mu.Lock()
+		if err != nil {
+			g.fails = append(g.fails, groupFail{durable: g.durable, err: err})
+			g.epoch++
+			g.broken = true
+			g.events = nil
+		} else {
+			g.durable = target
+			g.durableMeta = meta
+			g.durableWal = walSize
+			if !db.WAL {
+				g.slot = slot
+			}
+			if g.watch != nil {
+				publishDurable(g, target)
+			}
+		}
+		g.syncing = false
+		g.cond.Broadcast()
+	}
+}
+
+// publishDurable hands the events of the commits up to target to the
+// watchers, under g.mu so that the next leader cannot publish ahead of it.
+// Publishing never waits for a watcher.
+func publishDurable(g *commitGroup, target uint64) {
+	n := 0
+	for n < len(g.events) && g.events[n].Seq <= target {
+		n++
+	}
+	g.watch.publish(target, g.events[:n:n])
+	g.events = g.events[n:]
+}
+
+func syncCommit(db *KV, meta []byte, slot uint64) error {
+	if db.WAL {
+		return db.wal.file.Sync()
+	}
+	if err := db.file.Sync(); err != nil {
+		return err
+	}
+	if err := writeMetaSlot(db, meta, slot); err != nil {
+		return err
+	}
+	return db.file.Sync()
+}
+
+// waitIdle makes every prepared commit durable before the caller, which
+// holds the writer lock, rewrites the data file or the log underneath.
+func waitIdle(db *KV) error {
+	g := db.group()
+	g.mu.Lock()
+	seq, epoch := g.prepared, g.epoch
+	g.mu.Unlock()
+	return waitDurable(db, seq, epoch)
+}
+
+// repairCommit rolls the database back to the last durable commit after a
+// failed sync. The slot or log tail the failed sync may have written is
+// overwritten first, so a crash cannot resurrect the failed commits.
+func repairCommit(db *KV) error {
+	g := db.group()
+	g.mu.Lock()
+	meta, walSize, slot := g.durableMeta, g.durableWal, g.slot
+	g.mu.Unlock()
+	revertMeta(db, meta)
+	if db.WAL {
+		if err := walRevert(db, meta, walSize); err != nil {
+			return err
+		}
+	} else {
+		if err := writeMetaSlot(db, meta, slot^1); err != nil {
+			return err
+		}
+		if err := db.file.Sync(); err != nil {
+			return err
+		}
+	}
+	g.mu.Lock()
+	g.broken = false
+	g.prepared = g.durable
+	g.meta = g.durableMeta
+	g.walSize = g.durableWal
+	g.mu.Unlock()
+	return nil
+}
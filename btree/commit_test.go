@@ -0,0 +1,90 @@
+package btree
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentCommitsAreDurable(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		t.Run(fmt.Sprintf("wal=%v", wal), func(t *testing.T) {
+			kv := KV{WAL: wal}
+			openKV(t, &kv)
+			model := map[string]string{}
+			var mu sync.Mutex
+			var wg sync.WaitGroup
+			for w := 0; w < 8; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := 0; i < 40; i++ {
+						k := fmt.Sprintf("w%02d-%04d", w, i)
+						var err error
+						if i%2 == 0 {
+							err = kv.Set([]byte(k), []byte(k))
+						} else {
+							var tx *Tx
+							if tx, err = kv.BeginWrite(); err == nil {
+								if err = tx.Set([]byte(k), []byte(k)); err == nil {
+									err = tx.Commit()
+								}
+							}
+						}
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						mu.Lock()
+						model[k] = k
+						mu.Unlock()
+					}
+				}(w)
+			}
+			wg.Wait()
+			g := kv.group()
+			if g.durable != kv.seq || g.prepared != kv.seq {
+				t.Fatalf("durable %d, prepared %d, want both at %d", g.durable, g.prepared, kv.seq)
+			}
+			kv.Close()
+			openKV(t, &kv)
+			defer kv.Close()
+			checkModel(t, &kv, model)
+		})
+	}
+}
+
+func TestFailedCommitIsRolledBack(t *testing.T) {
+	kv := KV{WAL: true}
+	openKV(t, &kv)
+	defer kv.Close()
+	if err := kv.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	seq := kv.seq
+	// a handle opened read-only fails every write to the log
+	log := kv.wal.file
+	ro, err := os.Open(walPath(kv.Path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.wal.file = ro
+	if err := kv.Set([]byte("a"), []byte("2")); err == nil {
+		t.Fatal("the commit succeeded")
+	}
+	kv.wal.file = log
+	ro.Close()
+	if kv.seq != seq {
+		t.Fatalf("at commit %d after the failure, want %d", kv.seq, seq)
+	}
+	if v, _, err := kv.Get([]byte("a")); err != nil || string(v) != "1" {
+		t.Fatalf("a = %q %v after the failed commit", v, err)
+	}
+	if err := kv.Set([]byte("b"), []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	kv.Close()
+	openKV(t, &kv)
+	checkModel(t, &kv, map[string]string{"a": "1", "b": "3"})
+}
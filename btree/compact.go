@@ -0,0 +1,457 @@
+package btree
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// Compact gives the free space at the end of the file back to the OS. It
+// first moves the pages near the end into free slots lower down, rewriting
+// their ancestors copy-on-write, then cuts the file after the last page
+// still in use. A page freed after the oldest BeginRead guard started still
+// counts as in use, so readers never see a page move under them or vanish;
+// running Compact again once they are done reclaims the rest.
+func (db *KV) Compact() error {
+	if db.ReadOnly {
+		return ErrReadOnly
+	}
+	if err := db.compactMove(); err != nil {
+		return err
+	}
+	return db.compactTruncate()
+}
+
+// compactPage is a page reachable from a root. Pages are kept in the
+// order of a depth-first walk, so a parent comes before its children.
+type compactPage struct {
+	ptr      uint64
+	parent   int    // -1 for a root
+	slot     uint16 // child or cell index in the parent node
+	tree     int    // index in compactor.trees
+	overflow bool
+	moved    uint64
+}
+
+type compactor struct {
+	db    *KV
+	pool  []uint64 // free extents no reader can reach, by position
+	limit uint64   // allocations from the pool end at or below this unit
+	pages []compactPage
+	trees []*BTree // the main tree and the expiry index
+	nodes []uint64 // free list nodes, head first
+	held  uint64   // end of the free list entries readers may reach
+}
+
+// newCompactor drains every free list entry no reader can reach into the
+// pool, leaving the list with the others, and walks the list and the trees.
+func newCompactor(db *KV) (*compactor, error) {
+	c := &compactor{db: db, limit: ^uint64(0), trees: []*BTree{&db.tree, &db.ttl}}
+	allowed := min(db.OldestActiveReaderSeq(), db.free.maxSeq)
+	db.free.maxSeq = max(allowed, db.free.headSeq)
+	for {
+		ptr, head, err := flPop(&db.free)
+		if err != nil {
+			return nil, err
+		}
+		if ptr == 0 {
+			break
+		}
+		c.pool = append(c.pool, ptr)
+		if head != 0 {
+			c.pool = append(c.pool, head)
+		}
+	}
+	sort.Slice(c.pool, func(i, j int) bool {
+		a, _ := db.extentOf(c.pool[i])
+		b, _ := db.extentOf(c.pool[j])
+		return a < b
+	})
+	if db.page.compress {
+		// extents are freed one page at a time; merged, pages larger than
+		// any one of them fit
+		c.pool = coalesceExtents(c.pool)
+	}
+	err := db.free.visit(func(ptr uint64) {
+		c.nodes = append(c.nodes, ptr)
+	}, func(ptr uint64) {
+		c.held = max(c.held, c.end(ptr))
+	})
+	if err != nil {
+		return c, err
+	}
+	for i, tree := range c.trees {
+		if tree.root == 0 {
+			continue
+		}
+		if err := c.walk(tree.root, -1, 0, i); err != nil {
+			return c, err
+		}
+	}
+	return c, nil
+}
+
+func (c *compactor) walk(ptr uint64, parent int, slot uint16, tree int) error {
+	idx := len(c.pages)
+	c.pages = append(c.pages, compactPage{ptr: ptr, parent: parent, slot: slot, tree: tree})
+	node, err := c.db.tree.node(ptr)
+	if err != nil {
+		return err
+	}
+	for i := uint16(0); i < node.nkeys(); i++ {
+		switch {
+		case node.btype() == BNODE_NODE_TYPE:
+			if err := c.walk(node.getPtr(i), idx, i, tree); err != nil {
+				return err
+			}
+		case node.getFlags(i)&VAL_OVERFLOW != 0:
+			up, next := idx, binary.LittleEndian.Uint64(node.getVal(i)[4:])
+			for next != 0 {
+				c.pages = append(c.pages, compactPage{ptr: next, parent: up, slot: i, tree: tree, overflow: true})
+				up = len(c.pages) - 1
+				page, err := c.db.tree.get(next)
+				if err != nil {
+					return err
+				}
+				next = binary.LittleEndian.Uint64(page)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *compactor) end(ptr uint64) uint64 {
+	start, n := c.db.extentOf(ptr)
+	return start + uint64(n)
+}
+
+// usedEnd is where the file could end: after the free list entries
+// readers may still reach and, unless only those count, the list and the
+// tree.
+func (c *compactor) usedEnd(all bool) uint64 {
+	end, _ := c.db.initLayout()
+	end = max(end, c.held)
+	if all {
+		for _, ptr := range c.nodes {
+			end = max(end, c.end(ptr))
+		}
+		for _, p := range c.pages {
+			end = max(end, c.end(p.ptr))
+		}
+	}
+	return end
+}
+
+// mark selects the pages a cut at the given unit has to move, along with
+// their ancestors, whose pointers to them change.
+func (c *compactor) mark(cut uint64) []bool {
+	marked := make([]bool, len(c.pages))
+	for i := len(c.pages) - 1; i >= 0; i-- {
+		if c.end(c.pages[i].ptr) > cut {
+			marked[i] = true
+		}
+		if marked[i] && c.pages[i].parent >= 0 {
+			marked[c.pages[i].parent] = true
+		}
+	}
+	return marked
+}
+
+// fits reports whether the pool below a cut has room for the pages the
+// cut moves and for the free list nodes needed to push their old copies.
+func (c *compactor) fits(cut uint64) bool {
+	var need []int
+	for i, m := range c.mark(cut) {
+		if m {
+			_, n := c.db.extentOf(c.pages[i].ptr)
+			need = append(need, n)
+		}
+	}
+	nodes := 0
+	for _, ptr := range c.nodes {
+		if c.end(ptr) > cut {
+			nodes++
+		}
+	}
+	if len(need)+nodes == 0 {
+		return true
+	}
+	nodes += (len(need)+len(c.pool)+nodes)/FreeListCap(c.db.page.size) + 1
+	for i := 0; i < nodes; i++ {
+		need = append(need, c.db.rawSectors())
+	}
+	sim := compactor{db: c.db, pool: append([]uint64(nil), c.pool...), limit: cut}
+	for _, n := range need {
+		if sim.take(n) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// take carves n units out of the first pool extent below the limit that
+// is large enough.
+func (c *compactor) take(n int) uint64 {
+	for i, ptr := range c.pool {
+		start, have := c.db.extentOf(ptr)
+		if start+uint64(n) > c.limit {
+			return 0
+		}
+		if have < n {
+			continue
+		}
+		if have > n {
+			c.pool[i] = c.db.extentAt(start+uint64(n), have-n)
+		} else if i == 0 {
+			c.pool = c.pool[1:]
+		} else {
+			c.pool = append(c.pool[:i], c.pool[i+1:]...)
+		}
+		return c.db.extentAt(start, n)
+	}
+	return 0
+}
+
+// alloc places a copy of a page in the pool, or at the end of the file
+// when nothing below the limit fits.
+func (c *compactor) alloc(node []byte, list bool) uint64 {
+	db := c.db
+	copyBuf := db.pageCopy(node)
+	n := 1
+	if db.page.compress {
+		n = db.rawSectors()
+		if !list {
+			n = db.packedLen(copyBuf)
+		}
+	}
+	ptr := c.take(n)
+	if ptr == 0 {
+		return db.pageAppendN(copyBuf, n)
+	}
+	db.page.umu.Lock()
+	db.page.updates[ptr] = copyBuf
+	db.page.umu.Unlock()
+	return ptr
+}
+
+func (c *compactor) listNew(node []byte) (uint64, error) {
+	return c.alloc(node, true), nil
+}
+
+// moveList copies the free list nodes past the cut into the pool and
+// relinks them. Every entry keeps its position, so reader guards still
+// hold; the old nodes are freed once the list is consistent again.
+func (c *compactor) moveList(cut uint64) error {
+	db := c.db
+	moved := make([]uint64, len(c.nodes))
+	for i, ptr := range c.nodes {
+		if c.end(ptr) <= cut {
+			continue
+		}
+		page, err := db.pageRead(ptr)
+		if err != nil {
+			return err
+		}
+		moved[i] = c.alloc(page, true)
+	}
+	for i, ptr := range c.nodes {
+		if moved[i] == 0 {
+			continue
+		}
+		if i == 0 {
+			db.free.headPage = moved[i]
+		} else {
+			prev := c.nodes[i-1]
+			if moved[i-1] != 0 {
+				prev = moved[i-1]
+			}
+			page, err := db.free.set(prev)
+			if err != nil {
+				return err
+			}
+			LNode(page).setNext(moved[i])
+		}
+		if ptr == db.free.tailPage {
+			db.free.tailPage = moved[i]
+		}
+	}
+	for i, ptr := range c.nodes {
+		if moved[i] != 0 {
+			if err := db.free.PushTail(ptr); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// move rewrites the marked pages children first, pointing each copy at
+// the new copies of its children, and frees the old pages.
+func (c *compactor) move(marked []bool) error {
+	db := c.db
+	for i := len(c.pages) - 1; i >= 0; i-- {
+		if !marked[i] {
+			continue
+		}
+		page, err := db.tree.get(c.pages[i].ptr)
+		if err != nil {
+			return err
+		}
+		copyBuf := db.pageCopy(page)
+		for j := i + 1; j < len(c.pages) && c.pages[j].parent >= i; j++ {
+			kid := c.pages[j]
+			if kid.parent != i || kid.moved == 0 {
+				continue
+			}
+			switch {
+			case c.pages[i].overflow:
+				binary.LittleEndian.PutUint64(copyBuf, kid.moved)
+			case kid.overflow:
+				binary.LittleEndian.PutUint64(BNode(copyBuf).getVal(kid.slot)[4:], kid.moved)
+			default:
+				BNode(copyBuf).setPtr(kid.slot, kid.moved)
+			}
+		}
+		c.pages[i].moved = c.alloc(copyBuf, false)
+		if err := db.free.PushTail(c.pages[i].ptr); err != nil {
+			return err
+		}
+	}
+	for _, p := range c.pages {
+		if p.parent < 0 && p.moved != 0 {
+			c.trees[p.tree].root = p.moved
+		}
+	}
+	return nil
+}
+
+// compactMove relocates the pages past the lowest cut the free space
+// below it can absorb. Nothing is committed when no cut helps.
+func (db *KV) compactMove() error {
+	cc := getCC(db)
+	cc.wmu.Lock()
+	db.writeBegin()
+	meta := saveMeta(db)
+	moved, err := db.compactMoveTx()
+	db.free.new = db.listAppend
+	if err != nil || !moved {
+		revertMeta(db, meta)
+		cc.wmu.Unlock()
+		return err
+	}
+	return commitTx(db, meta, cc.wmu.Unlock)
+}
+
+func (db *KV) compactMoveTx() (bool, error) {
+	c, err := newCompactor(db)
+	if err != nil {
+		return false, err
+	}
+	floor := c.usedEnd(false)
+	flushed := db.page.flushed
+	if floor >= flushed {
+		return false, nil
+	}
+	cut := floor + uint64(sort.Search(int(flushed-floor), func(i int) bool {
+		return c.fits(floor + uint64(i))
+	}))
+	if cut >= flushed {
+		return false, nil
+	}
+	c.limit = cut
+	db.free.new = c.listNew
+	if err := c.moveList(cut); err != nil {
+		return false, err
+	}
+	if err := c.move(c.mark(cut)); err != nil {
+		return false, err
+	}
+	// PushTail may take list nodes from the pool, so pop as we go
+	for len(c.pool) > 0 {
+		ptr := c.pool[len(c.pool)-1]
+		c.pool = c.pool[:len(c.pool)-1]
+		if err := db.free.PushTail(ptr); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// compactTruncate drops the free extents after the last page in use and
+// shrinks the file. The writer lock is held until the file is cut, so no
+// commit can append in the meantime.
+func (db *KV) compactTruncate() error {
+	cc := getCC(db)
+	cc.wmu.Lock()
+	defer cc.wmu.Unlock()
+	db.writeBegin()
+	meta := saveMeta(db)
+	end, err := db.compactTruncateTx()
+	db.free.new = db.listAppend
+	if err != nil || end == 0 {
+		revertMeta(db, meta)
+		return err
+	}
+	seq, epoch, err := prepareCommit(db, meta)
+	if err != nil {
+		return err
+	}
+	if err := waitDurable(db, seq, epoch); err != nil {
+		return err
+	}
+	if db.WAL {
+		if err := walCheckpoint(db); err != nil {
+			return err
+		}
+	}
+	return db.fileShrink(end)
+}
+
+// compactTruncateTx returns the new end of the file, or 0 when it cannot
+// shrink.
+func (db *KV) compactTruncateTx() (uint64, error) {
+	c, err := newCompactor(db)
+	if err != nil {
+		return 0, err
+	}
+	end := c.usedEnd(true)
+	if end >= db.page.flushed {
+		return 0, nil
+	}
+	c.limit = end
+	db.free.new = c.listNew
+	for len(c.pool) > 0 {
+		ptr := c.pool[len(c.pool)-1]
+		c.pool = c.pool[:len(c.pool)-1]
+		start, n := db.extentOf(ptr)
+		if start >= end {
+			continue
+		}
+		if start+uint64(n) > end {
+			ptr = db.extentAt(start, int(end-start))
+		}
+		if err := db.free.PushTail(ptr); err != nil {
+			return 0, err
+		}
+	}
+	db.page.umu.Lock()
+	defer db.page.umu.Unlock()
+	if db.page.nappend != 0 {
+		// a new free list node did not fit below the end
+		return 0, nil
+	}
+	db.page.flushed = end
+	return end, nil
+}
+
+func (db *KV) fileShrink(units uint64) error {
+	size := int64(units) * int64(db.unitSize())
+	if err := db.file.Truncate(size); err != nil {
+		return err
+	}
+	if db.Mmap {
+		db.mmap.mu.Lock()
+		db.mmap.size = min(db.mmap.size, size)
+		db.mmap.mu.Unlock()
+	}
+	return db.file.Sync()
+}
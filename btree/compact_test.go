@@ -0,0 +1,155 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st.Size()
+}
+
+// shrinkable fills kv, then deletes nine keys in ten, and returns what is
+// left.
+func shrinkable(t *testing.T, kv *KV) map[string]string {
+	t.Helper()
+	model := map[string]string{}
+	for b := 0; b < 3; b++ {
+		tx, err := kv.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			k := testKey(b*1000 + i)
+			v := fmt.Sprintf("%d%s", i, bytes.Repeat([]byte("z"), i%300))
+			if err := tx.Set(k, []byte(v)); err != nil {
+				t.Fatal(err)
+			}
+			model[string(k)] = v
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tx, err := kv.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3000; i++ {
+		if i%10 != 0 {
+			k := testKey(i)
+			if _, err := tx.Del(k); err != nil {
+				t.Fatal(err)
+			}
+			delete(model, string(k))
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	return model
+}
+
+func TestCompactShrinksTheFile(t *testing.T) {
+	modes := []struct {
+		WAL, Compress bool
+		Key           []byte
+	}{{}, {WAL: true}, {Compress: true}, {Key: testKeyA}}
+	for _, mode := range modes {
+		t.Run(fmt.Sprintf("wal=%v,compress=%v,key=%v", mode.WAL, mode.Compress, mode.Key != nil), func(t *testing.T) {
+			kv := KV{WAL: mode.WAL, Compress: mode.Compress, Key: mode.Key}
+			openKV(t, &kv)
+			defer kv.Close()
+			model := shrinkable(t, &kv)
+			before := fileSize(t, kv.Path)
+			if err := kv.Compact(); err != nil {
+				t.Fatal(err)
+			}
+			if after := fileSize(t, kv.Path); after*2 > before {
+				t.Fatalf("the file went from %d to %d bytes", before, after)
+			}
+			checkTree(t, &kv.tree)
+			checkModel(t, &kv, model)
+			if err := kv.Set([]byte("after"), []byte("x")); err != nil {
+				t.Fatal(err)
+			}
+			model["after"] = "x"
+			kv.Close()
+			openKV(t, &kv)
+			checkModel(t, &kv, model)
+		})
+	}
+}
+
+// A snapshot taken before the deletes keeps reading its pages while
+// Compact runs; they are reclaimed once it ends.
+func TestCompactKeepsPagesOfReaders(t *testing.T) {
+	kv := KV{}
+	openKV(t, &kv)
+	defer kv.Close()
+	fillKV(t, &kv, 3000)
+	old := kv.BeginReadTx()
+	tx, err := kv.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.DeleteRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	before := fileSize(t, kv.Path)
+	if err := kv.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3000; i++ {
+		if _, ok, err := old.Get(testKey(i)); err != nil || !ok {
+			t.Fatalf("snapshot lost %q: %v", testKey(i), err)
+		}
+	}
+	old.End()
+	if err := kv.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if after := fileSize(t, kv.Path); after*4 > before {
+		t.Fatalf("the file went from %d to %d bytes", before, after)
+	}
+	checkModel(t, &kv, map[string]string{})
+}
+
+// Compact moves the pages of the expiry index too.
+func TestCompactWithExpiringKeys(t *testing.T) {
+	kv := KV{}
+	openKV(t, &kv)
+	defer kv.Close()
+	model := shrinkable(t, &kv)
+	for i := 0; i < 200; i++ {
+		k := fmt.Sprintf("ttl%04d", i)
+		if err := kv.SetWithTTL([]byte(k), []byte("x"), time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		model[k] = "x"
+	}
+	if err := kv.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, &kv.tree)
+	checkTree(t, &kv.ttl)
+	checkModel(t, &kv, model)
+	kv.Close()
+	openKV(t, &kv)
+	checkTree(t, &kv.ttl)
+	checkModel(t, &kv, model)
+}
@@ -0,0 +1,213 @@
+package btree
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// With compression on, the file is divided into sectors of a sixteenth of
+// a page, and a page pointer addresses the extent holding the deflated
+// page: the first sector shifted left by 5, or'ed with the number of
+// sectors. A page that does not shrink below a full page is stored raw, as
+// are free list nodes, which are rewritten in place. Free extents go
+// through the free list like pages do; an allocation keeps the sectors it
+// needs and returns the rest. The extents a write frees are held until it
+// commits and merged with their neighbours first.
+const (
+	COMPRESS_SECTORS = 16
+	extentLenBits    = 5
+)
+
+func extentPtr(sector uint64, n int) uint64 {
+	return sector<<extentLenBits | uint64(n)
+}
+
+func extentSector(ptr uint64) uint64 {
+	return ptr >> extentLenBits
+}
+
+func extentLen(ptr uint64) int {
+	return int(ptr & (1<<extentLenBits - 1))
+}
+
+// unitSize is the number of bytes counted by page.flushed and page.nappend.
+func (db *KV) unitSize() int {
+	if db.page.compress {
+		return db.page.size / COMPRESS_SECTORS
+	}
+	return db.page.size + db.sealOverhead()
+}
+
+// rawSectors is the extent length of a page stored as it is.
+func (db *KV) rawSectors() int {
+	unit := db.unitSize()
+	return (db.page.size + db.sealOverhead() + unit - 1) / unit
+}
+
+// fileRange is where the image of a page lives in the file.
+func (db *KV) fileRange(ptr uint64) (int64, int) {
+	unit := db.unitSize()
+	if !db.page.compress {
+		return int64(ptr) * int64(unit), unit
+	}
+	return int64(extentSector(ptr)) * int64(unit), extentLen(ptr) * unit
+}
+
+// extentOf is the first unit and the number of units a page pointer
+// covers; extentAt is the inverse.
+func (db *KV) extentOf(ptr uint64) (uint64, int) {
+	if !db.page.compress {
+		return ptr, 1
+	}
+	return extentSector(ptr), extentLen(ptr)
+}
+
+func (db *KV) extentAt(start uint64, n int) uint64 {
+	if !db.page.compress {
+		return start
+	}
+	return extentPtr(start, n)
+}
+
+var flateWriters = sync.Pool{
+	New: func() any {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+var flateReaders sync.Pool
+
+func deflatePage(pg []byte) []byte {
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	w.Reset(&buf)
+	_, _ = w.Write(pg)
+	_ = w.Close()
+	flateWriters.Put(w)
+	return buf.Bytes()
+}
+
+func inflatePage(data []byte, pageSize int) ([]byte, error) {
+	var r io.ReadCloser
+	if v := flateReaders.Get(); v != nil {
+		r = v.(io.ReadCloser)
+		_ = r.(flate.Resetter).Reset(bytes.NewReader(data), nil)
+	} else {
+		r = flate.NewReader(bytes.NewReader(data))
+	}
+	defer flateReaders.Put(r)
+	pg := make([]byte, pageSize)
+	if _, err := io.ReadFull(r, pg); err != nil {
+		return nil, err
+	}
+	return pg, nil
+}
+
+// packedLen is the number of sectors a page will take once written. It is
+// fixed when the page is allocated, so the page must not change afterwards;
+// the checksum is stamped first since writePage stamps it too.
+func (db *KV) packedLen(pg []byte) int {
+	pageSetChecksum(pg)
+	unit := db.unitSize()
+	n := (len(deflatePage(pg)) + db.sealOverhead() + unit - 1) / unit
+	return min(n, db.rawSectors())
+}
+
+// packPage returns the bytes writePage stores for a checksummed page,
+// padded to the whole extent so that one at the end of the file reads back.
+// The padding goes under the seal, which then fills the extent exactly.
+func (db *KV) packPage(ptr uint64, pg []byte) ([]byte, error) {
+	_, size := db.fileRange(ptr)
+	size -= db.sealOverhead()
+	data := pg
+	if db.page.compress && extentLen(ptr) != db.rawSectors() {
+		data = deflatePage(pg)
+	}
+	if len(data) > size {
+		return nil, fmt.Errorf("page %d: compressed image outgrew its extent", ptr)
+	}
+	if len(data) < size {
+		data = append(data[:len(data):len(data)], make([]byte, size-len(data))...)
+	}
+	return db.seal(data, pageAD(ptr)), nil
+}
+
+// unpackPage reverses packPage.
+func (db *KV) unpackPage(ptr uint64, data []byte) ([]byte, error) {
+	if db.page.aead != nil {
+		var err error
+		if data, err = db.unseal(data, pageAD(ptr)); err != nil {
+			return nil, &PageError{Page: ptr, Err: ErrCorruptPage}
+		}
+	}
+	if !db.page.compress || extentLen(ptr) == db.rawSectors() {
+		return data[:db.page.size], nil
+	}
+	pg, err := inflatePage(data, db.page.size)
+	if err != nil {
+		return nil, &PageError{Page: ptr, Err: ErrCorruptPage}
+	}
+	return pg, nil
+}
+
+// extentTake carves n sectors out of a free extent. The remainder goes back
+// to the free list; an extent that is too small goes back whole and the
+// caller appends instead.
+func (db *KV) extentTake(free uint64, n int) (uint64, error) {
+	have := extentLen(free)
+	if have < n {
+		return 0, db.extentFree(free)
+	}
+	if have > n {
+		rest := extentPtr(extentSector(free)+uint64(n), have-n)
+		if err := db.extentFree(rest); err != nil {
+			return 0, err
+		}
+	}
+	return extentPtr(extentSector(free), n), nil
+}
+
+// extentFree holds a freed extent for extentFlush. Like any entry pushed
+// during a write, it could not be reused before the commit anyway.
+func (db *KV) extentFree(ptr uint64) error {
+	db.page.freed = append(db.page.freed, ptr)
+	return nil
+}
+
+// extentFlush puts the extents freed by the write on the free list, merged
+// where they adjoin.
+func (db *KV) extentFlush() error {
+	freed := db.page.freed
+	db.page.freed = nil
+	sort.Slice(freed, func(i, j int) bool {
+		return extentSector(freed[i]) < extentSector(freed[j])
+	})
+	for _, ptr := range coalesceExtents(freed) {
+		if err := db.free.PushTail(ptr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// coalesceExtents merges adjacent extents of a list sorted by position, as
+// far as the length of an extent pointer allows, reusing its storage.
+func coalesceExtents(ptrs []uint64) []uint64 {
+	merged := ptrs[:0]
+	for _, ptr := range ptrs {
+		if k := len(merged) - 1; k >= 0 {
+			start, n := extentSector(merged[k]), extentLen(merged[k])
+			if start+uint64(n) == extentSector(ptr) && n+extentLen(ptr) < 1<<extentLenBits {
+				merged[k] = extentPtr(start, n+extentLen(ptr))
+				continue
+			}
+		}
+		merged = append(merged, ptr)
+	}
+	return merged
+}
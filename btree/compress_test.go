@@ -0,0 +1,128 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestCompressedDatabase(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		t.Run(fmt.Sprintf("wal=%v", wal), func(t *testing.T) {
+			kv := KV{Compress: true, WAL: wal}
+			openKV(t, &kv)
+			defer kv.Close()
+			model := map[string]string{}
+			for round := 0; round < 4; round++ {
+				tx, err := kv.Begin()
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i := 0; i < 400; i++ {
+					k := testKey((i*13 + round) % 700)
+					v := string(bytes.Repeat([]byte(fmt.Sprintf("%d-%d|", round, i)), i%50))
+					if err := tx.Set(k, []byte(v)); err != nil {
+						t.Fatal(err)
+					}
+					model[string(k)] = v
+				}
+				if err := tx.Commit(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			checkTree(t, &kv.tree)
+			checkModel(t, &kv, model)
+			kv.Close()
+			// compression is recorded in the file
+			kv.Compress = false
+			openKV(t, &kv)
+			if !kv.page.compress {
+				t.Fatal("reopened without compression")
+			}
+			checkModel(t, &kv, model)
+		})
+	}
+}
+
+func TestCompressionShrinksTheFile(t *testing.T) {
+	var sizes [2]int64
+	for i, compress := range []bool{false, true} {
+		kv := KV{Compress: compress}
+		openKV(t, &kv)
+		tx, err := kv.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2000; i++ {
+			v := fmt.Sprintf(`{"id":%d,"name":"customer %d","status":"active","tags":["a","b"]}`, i, i)
+			if err := tx.Set(testKey(i), []byte(v)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		kv.Close()
+		st, err := os.Stat(kv.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[i] = st.Size()
+	}
+	if sizes[1]*2 > sizes[0] {
+		t.Fatalf("compressed file of %d bytes, %d raw", sizes[1], sizes[0])
+	}
+}
+
+func TestCoalesceExtents(t *testing.T) {
+	max := 1<<extentLenBits - 1
+	got := coalesceExtents([]uint64{
+		extentPtr(0, 3), extentPtr(3, 2), extentPtr(5, 4),
+		extentPtr(10, 1),
+		extentPtr(20, max-1), extentPtr(20+uint64(max-1), 2),
+	})
+	want := []uint64{
+		extentPtr(0, 9),
+		extentPtr(10, 1),
+		// merged they would not fit a pointer
+		extentPtr(20, max-1), extentPtr(20+uint64(max-1), 2),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+// Rewriting the same keys over and over frees neighbouring extents in
+// each commit, which reach the free list merged.
+func TestFreedExtentsAreMerged(t *testing.T) {
+	kv := KV{Compress: true}
+	openKV(t, &kv)
+	defer kv.Close()
+	for round := 0; round < 20; round++ {
+		tx, err := kv.BeginWrite()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 300; i++ {
+			v := bytes.Repeat([]byte(fmt.Sprintf("%d-%d", round, i)), 10+round*i%40)
+			if err := tx.Set(testKey(i), v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	big := 0
+	kv.free.visit(func(uint64) {}, func(ptr uint64) {
+		if extentLen(ptr) > kv.rawSectors() {
+			big++
+		}
+	})
+	if big == 0 {
+		t.Fatal("no free extent is larger than a page")
+	}
+	checkTree(t, &kv.tree)
+}
@@ -3,15 +3,51 @@ package btree
 const (
 	BNODE_NODE_TYPE = 1
 	BNODE_LEAF_TYPE = 2
+	BNODE_PREFIXED  = 0x100
 )
 
+// BTREE_PAGE_SIZE is the page size of a new database unless KV.PageSize
+// picks another one from PAGE_SIZES. The key and value limits are those of
+// a default page; they grow in proportion with larger pages.
 const (
 	BTREE_PAGE_SIZE    = 4096
 	BTREE_MAX_KEY_SIZE = 1000
 	BTREE_MAX_VAL_SIZE = 3000
 )
 
+var PAGE_SIZES = []int{4096, 8192, 16384}
+
+const PAGE_CHECKSUM_SIZE = 4
+
+func validPageSize(size int) bool {
+	for _, s := range PAGE_SIZES {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeCap is the number of bytes a node may use in a page; the rest is
+// the checksum trailer.
+func nodeCap(pageSize int) int {
+	return pageSize - PAGE_CHECKSUM_SIZE
+}
+
+func maxKeySize(pageSize int) int {
+	return BTREE_MAX_KEY_SIZE * pageSize / BTREE_PAGE_SIZE
+}
+
+func maxValSize(pageSize int) int {
+	return BTREE_MAX_VAL_SIZE * pageSize / BTREE_PAGE_SIZE
+}
+
 func init() {
-	node1max := 4 + 1*8 + 1*2 + 4 + BTREE_MAX_KEY_SIZE + BTREE_MAX_VAL_SIZE
-	assert(node1max <= BTREE_PAGE_SIZE)
+	for _, size := range PAGE_SIZES {
+		node1max := 4 + 1*8 + 1*2 + 4 + maxKeySize(size) + maxValSize(size) + EXPIRY_SIZE
+		assert(node1max <= nodeCap(size))
+		assert(maxValSize(size)+EXPIRY_SIZE <= VAL_LEN_MASK)
+		// a node being split is built in a buffer of four pages
+		assert(4*size <= 1<<16)
+	}
 }
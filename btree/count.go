@@ -0,0 +1,147 @@
+package btree
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Each cell of an internal node carries, as its value, the number of keys
+// in the subtree it points to, the empty key of the leftmost leaf included.
+// Whoever writes a cell for a new child takes the count from the child
+// node itself; cells copied from another node keep theirs.
+
+func countVal(n uint64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, n)
+}
+
+func (node BNode) getCount(idx uint16) uint64 {
+	return binary.LittleEndian.Uint64(node.getVal(idx))
+}
+
+// nodeCount is the number of keys under node.
+func nodeCount(node BNode) uint64 {
+	if node.btype() == BNODE_LEAF_TYPE {
+		return uint64(node.nkeys())
+	}
+	var n uint64
+	for i := uint16(0); i < node.nkeys(); i++ {
+		n += node.getCount(i)
+	}
+	return n
+}
+
+// Rank returns the number of keys less than key.
+func (tree *BTree) Rank(key []byte) (int, error) {
+	if tree.root == 0 {
+		return 0, nil
+	}
+	var n uint64
+	for ptr := tree.root; ; {
+		node, err := tree.node(ptr)
+		if err != nil {
+			return 0, err
+		}
+		if node.nkeys() == 0 || node.cmpKey(0, key) >= 0 {
+			break
+		}
+		idx := nodeLookupLE(node, key)
+		if node.btype() == BNODE_LEAF_TYPE {
+			n += uint64(idx) + 1
+			if node.cmpKey(idx, key) == 0 {
+				n--
+			}
+			break
+		}
+		for i := uint16(0); i < idx; i++ {
+			n += node.getCount(i)
+		}
+		ptr = node.getPtr(idx)
+	}
+	// the empty key sorts before any other
+	if n > 0 {
+		n--
+	}
+	return int(n), nil
+}
+
+// CountRange returns the number of keys in [start, end); a nil bound is
+// open.
+func (tree *BTree) CountRange(start []byte, end []byte) (int, error) {
+	lo, err := tree.Rank(start)
+	if err != nil {
+		return 0, err
+	}
+	var hi int
+	if end == nil {
+		hi, err = tree.count()
+	} else {
+		hi, err = tree.Rank(end)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return max(hi-lo, 0), nil
+}
+
+// count is the number of keys in the tree.
+func (tree *BTree) count() (int, error) {
+	if tree.root == 0 {
+		return 0, nil
+	}
+	root, err := tree.node(tree.root)
+	if err != nil {
+		return 0, err
+	}
+	return int(nodeCount(root)) - 1, nil
+}
+
+// SeekIndex positions the iterator on the key with n keys before it, going
+// down by the subtree counts rather than visiting those keys. Next and
+// Prev are unbounded. If that key has expired, the iterator moves on to
+// the next live one.
+func (it *Iter) SeekIndex(n int) bool {
+	it.now = time.Now().UnixNano()
+	it.seekIndex(n)
+	return it.live(it.next)
+}
+
+func (it *Iter) seekIndex(n int) bool {
+	it.stack = it.stack[:0]
+	it.start, it.end = nil, nil
+	if it.tree == nil {
+		return false
+	}
+	it.err = nil
+	it.ok = false
+	if it.tree.root == 0 || n < 0 {
+		return false
+	}
+	// skip the empty key
+	pos := uint64(n) + 1
+	ptr := it.tree.root
+	for {
+		node, err := it.tree.node(ptr)
+		if err != nil {
+			return it.fail(err)
+		}
+		if node.btype() == BNODE_LEAF_TYPE {
+			if pos >= uint64(node.nkeys()) {
+				return false
+			}
+			it.setLeaf(ptr, node)
+			it.idx = int(pos)
+			it.ok = true
+			return true
+		}
+		idx := uint16(0)
+		for idx < node.nkeys() && pos >= node.getCount(idx) {
+			pos -= node.getCount(idx)
+			idx++
+		}
+		if idx == node.nkeys() {
+			return false
+		}
+		it.stack = append(it.stack, iterFrame{ptr: ptr, idx: int(idx)})
+		ptr = node.getPtr(idx)
+	}
+}
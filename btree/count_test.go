@@ -0,0 +1,130 @@
+package btree
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// checkCounts checks the stored subtree counts, and Rank, CountRange and
+// SeekIndex at random keys, against model.
+func checkCounts(t *testing.T, kv *KV, model map[string]string, r *rand.Rand) {
+	t.Helper()
+	checkTree(t, &kv.tree)
+	keys := make([]string, 0, len(model))
+	for k := range model {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if n, err := kv.CountRange(nil, nil); err != nil || n != len(keys) {
+		t.Fatalf("%d keys counted, want %d: %v", n, len(keys), err)
+	}
+	rt := kv.BeginReadTx()
+	defer rt.End()
+	for i := 0; i < 30; i++ {
+		probe := fmt.Sprintf("k%05d", r.Intn(4000))
+		if i%3 == 0 && len(keys) > 0 {
+			probe = keys[r.Intn(len(keys))]
+		}
+		want := sort.SearchStrings(keys, probe)
+		if got, err := rt.Rank([]byte(probe)); err != nil || got != want {
+			t.Fatalf("rank of %q is %d, want %d: %v", probe, got, want, err)
+		}
+		end := fmt.Sprintf("k%05d", r.Intn(4000))
+		inside := max(sort.SearchStrings(keys, end)-want, 0)
+		if got, err := rt.CountRange([]byte(probe), []byte(end)); err != nil || got != inside {
+			t.Fatalf("[%q, %q) holds %d keys, want %d: %v", probe, end, got, inside, err)
+		}
+		below, _ := rt.CountRange(nil, []byte(probe))
+		above, _ := rt.CountRange([]byte(probe), nil)
+		if below != want || above != len(keys)-want {
+			t.Fatalf("%d keys below %q and %d above, want %d and %d", below, probe, above, want, len(keys)-want)
+		}
+	}
+	it := rt.NewIter()
+	defer it.Close()
+	for j := 0; j < 30 && len(keys) > 0; j++ {
+		i := r.Intn(len(keys))
+		if !it.SeekIndex(i) || string(it.Key()) != keys[i] {
+			t.Fatalf("SeekIndex(%d) at %q, want %q", i, it.Key(), keys[i])
+		}
+		if i > 0 {
+			if !it.Prev() || string(it.Key()) != keys[i-1] {
+				t.Fatalf("Prev after SeekIndex(%d) at %q", i, it.Key())
+			}
+		} else if it.Prev() {
+			t.Fatal("Prev went before the first key")
+		}
+	}
+	if it.SeekIndex(len(keys)) || it.SeekIndex(-1) {
+		t.Fatal("SeekIndex found a key out of range")
+	}
+}
+
+func TestCounts(t *testing.T) {
+	kv := KV{}
+	openKV(t, &kv)
+	defer kv.Close()
+	r := rand.New(rand.NewSource(1))
+	model := map[string]string{}
+	checkCounts(t, &kv, model, r)
+	var bulk []string
+	for i := 1000; i < 2500; i++ {
+		k := fmt.Sprintf("k%05d", i)
+		bulk = append(bulk, k)
+		model[k] = fmt.Sprint(i)
+	}
+	if err := kv.BulkLoad(sliceSource(bulk, model)); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, &kv, model, r)
+	for round := 0; round < 10; round++ {
+		tx, err := kv.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 300; j++ {
+			k := fmt.Sprintf("k%05d", r.Intn(4000))
+			if r.Intn(3) == 0 {
+				if _, err := tx.Del([]byte(k)); err != nil {
+					t.Fatal(err)
+				}
+				delete(model, k)
+				continue
+			}
+			v := fmt.Sprintf("v%d-%d", round, j)
+			if r.Intn(40) == 0 {
+				v = string(make([]byte, 5000))
+			}
+			if err := tx.Set([]byte(k), []byte(v)); err != nil {
+				t.Fatal(err)
+			}
+			model[k] = v
+		}
+		if round%3 == 2 {
+			a, b := r.Intn(4000), r.Intn(4000)
+			start, end := fmt.Sprintf("k%05d", min(a, b)), fmt.Sprintf("k%05d", max(a, b))
+			if _, err := tx.DeleteRange([]byte(start), []byte(end)); err != nil {
+				t.Fatal(err)
+			}
+			for k := range model {
+				if k >= start && k < end {
+					delete(model, k)
+				}
+			}
+		}
+		// a transaction counts its own writes
+		if n, err := tx.CountRange(nil, nil); err != nil || n != len(model) {
+			t.Fatalf("the tx counts %d keys, want %d: %v", n, len(model), err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		checkCounts(t, &kv, model, r)
+	}
+	if _, err := kv.DeleteRange(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, &kv, map[string]string{}, r)
+}
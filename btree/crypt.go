@@ -0,0 +1,159 @@
+package btree
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// With KV.Key set, every image that reaches the data file or the log is
+// sealed with AES-GCM: a random nonce, the ciphertext, then the tag. Pages
+// are bound to their pointer as additional data, so a page copied to
+// another place in the file fails to open like a tampered one. A sealed
+// page is SEAL_OVERHEAD bytes longer than the page: without compression
+// every page slot is widened by that much, with compression the extent
+// takes the sectors it needs.
+const (
+	SEAL_NONCE_SIZE = 12
+	SEAL_TAG_SIZE   = 16
+	SEAL_OVERHEAD   = SEAL_NONCE_SIZE + SEAL_TAG_SIZE
+)
+
+// ErrBadKey is returned by Open when no meta block can be opened with the
+// key, or when a key is given for a database that is not encrypted.
+var ErrBadKey = errors.New("wrong key or not an encrypted database")
+
+var (
+	metaAD = []byte("meta")
+	walAD  = []byte("wal")
+)
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+func pageAD(ptr uint64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, ptr)
+}
+
+func (db *KV) sealOverhead() int {
+	if db.page.aead == nil {
+		return 0
+	}
+	return SEAL_OVERHEAD
+}
+
+func (db *KV) seal(data []byte, ad []byte) []byte {
+	if db.page.aead == nil {
+		return data
+	}
+	nonce := make([]byte, SEAL_NONCE_SIZE, SEAL_OVERHEAD+len(data))
+	_, _ = rand.Read(nonce)
+	return db.page.aead.Seal(nonce, nonce, data, ad)
+}
+
+func (db *KV) unseal(data []byte, ad []byte) ([]byte, error) {
+	if db.page.aead == nil {
+		return data, nil
+	}
+	if len(data) < SEAL_OVERHEAD {
+		return nil, errors.New("sealed image too short")
+	}
+	return db.page.aead.Open(nil, data[:SEAL_NONCE_SIZE], data[SEAL_NONCE_SIZE:], ad)
+}
+
+// Rekey rewrites the database at path under newKey and replaces the file
+// once the copy is durable. Either key may be nil to encrypt a plain
+// database or to decrypt one. The database must not be open elsewhere.
+func Rekey(path string, oldKey, newKey []byte) error {
+	src := KV{Path: path, Key: oldKey}
+	if _, err := os.Stat(walPath(path)); err == nil {
+		src.WAL = true
+	}
+	if err := src.Open(); err != nil {
+		return err
+	}
+	tmp := path + ".rekey"
+	_ = os.Remove(tmp)
+	dst := KV{Path: tmp, Key: newKey, PageSize: src.page.size, Compress: src.page.compress}
+	err := dst.Open()
+	if err == nil {
+		err = rekeyCopy(&src, &dst)
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := src.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	if src.WAL {
+		if err := os.Remove(walPath(path)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// rekeyCopy moves the keys over in bounded transactions, since a
+// transaction keeps every page it touches in memory until commit. Keys
+// keep their expiry times; those already expired are left behind.
+func rekeyCopy(src, dst *KV) error {
+	const batch = 1024
+	r := src.BeginReadTx()
+	defer r.End()
+	it := r.NewIter()
+	defer it.Close()
+	tx, err := dst.Begin()
+	if err != nil {
+		return err
+	}
+	n := 0
+	for ok := it.SeekGE(nil, nil); ok; ok = it.Next() {
+		val := it.Val()
+		if err = it.Err(); err == nil {
+			err = tx.db.setExpiring(it.Key(), val, it.expiresAt())
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if n++; n%batch == 0 {
+			if err := tx.Commit(); err != nil {
+				return err
+			}
+			if tx, err = dst.Begin(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := it.Err(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
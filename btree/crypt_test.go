@@ -0,0 +1,141 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+var (
+	testKeyA = bytes.Repeat([]byte{7}, 32)
+	testKeyB = bytes.Repeat([]byte{9}, 16)
+)
+
+// fillKV commits n keys with values that compress well.
+func fillKV(t *testing.T, kv *KV, n int) map[string]string {
+	t.Helper()
+	model := map[string]string{}
+	tx, err := kv.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		k := testKey(i)
+		v := fmt.Sprintf("v%d%s", i, bytes.Repeat([]byte("y"), i%100))
+		if err := tx.Set(k, []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+		model[string(k)] = v
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return model
+}
+
+func TestEncryptedDatabase(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		for _, compress := range []bool{false, true} {
+			t.Run(fmt.Sprintf("wal=%v,compress=%v", wal, compress), func(t *testing.T) {
+				kv := KV{Key: testKeyA, WAL: wal, Compress: compress}
+				openKV(t, &kv)
+				model := fillKV(t, &kv, 1000)
+				if err := kv.Set([]byte("big"), bytes.Repeat([]byte("z"), 20000)); err != nil {
+					t.Fatal(err)
+				}
+				model["big"] = string(bytes.Repeat([]byte("z"), 20000))
+				kv.Close()
+				for _, path := range []string{kv.Path, walPath(kv.Path)} {
+					raw, err := os.ReadFile(path)
+					if err != nil && !os.IsNotExist(err) {
+						t.Fatal(err)
+					}
+					if bytes.Contains(raw, []byte("k0001")) || bytes.Contains(raw, []byte(DB_SIG)) {
+						t.Fatalf("%s holds plaintext", path)
+					}
+				}
+				openKV(t, &kv)
+				defer kv.Close()
+				checkModel(t, &kv, model)
+			})
+		}
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	kv := KV{Key: testKeyA}
+	openKV(t, &kv)
+	fillKV(t, &kv, 10)
+	kv.Close()
+	for _, key := range [][]byte{testKeyB, nil} {
+		other := KV{Path: kv.Path, Key: key}
+		if err := other.Open(); !errors.Is(err, ErrBadKey) {
+			other.Close()
+			t.Fatalf("opened with key %x: %v", key, err)
+		}
+	}
+
+	plain := KV{}
+	openKV(t, &plain)
+	fillKV(t, &plain, 10)
+	plain.Close()
+	keyed := KV{Path: plain.Path, Key: testKeyA}
+	if err := keyed.Open(); !errors.Is(err, ErrBadKey) {
+		keyed.Close()
+		t.Fatalf("opened a plain database with a key: %v", err)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	kv := KV{Key: testKeyA, PageSize: 8192, Compress: true}
+	openKV(t, &kv)
+	model := fillKV(t, &kv, 1000)
+	kv.Close()
+	if err := Rekey(kv.Path, testKeyB, testKeyA); !errors.Is(err, ErrBadKey) {
+		t.Fatalf("rekeyed with the wrong old key: %v", err)
+	}
+	steps := []struct{ from, to []byte }{
+		{testKeyA, testKeyB}, // rotate
+		{testKeyB, nil},      // decrypt
+		{nil, testKeyA},      // encrypt
+	}
+	for _, s := range steps {
+		if err := Rekey(kv.Path, s.from, s.to); err != nil {
+			t.Fatal(err)
+		}
+		got := KV{Path: kv.Path, Key: s.to}
+		if err := got.Open(); err != nil {
+			t.Fatal(err)
+		}
+		checkModel(t, &got, model)
+		if got.page.size != 8192 || !got.page.compress {
+			t.Fatal("the page size or compression was lost")
+		}
+		got.Close()
+	}
+}
+
+func TestTamperedPageIsReported(t *testing.T) {
+	for _, zero := range []bool{false, true} {
+		kv := KV{Key: testKeyA}
+		openKV(t, &kv)
+		fillKV(t, &kv, 1000)
+		_, size := kv.fileRange(kv.tree.root)
+		root := kv.tree.root
+		kv.Close()
+		if zero {
+			// a zeroed page does not pass for an empty one
+			damage(t, &kv, root, 0, make([]byte, size))
+		} else {
+			damage(t, &kv, root, 40, []byte{0xff})
+		}
+		openKV(t, &kv)
+		_, _, err := kv.Get(testKey(1))
+		kv.Close()
+		if !errors.Is(err, ErrCorruptPage) {
+			t.Fatalf("zero=%v: %v", zero, err)
+		}
+	}
+}
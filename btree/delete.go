@@ -1,48 +1,75 @@
 package btree
 
-import "bytes"
-
-func treeDelete(tree *BTree, node BNode, key []byte) BNode {
-	newNode := BNode(make([]byte, BTREE_PAGE_SIZE))
+func treeDelete(tree *BTree, node BNode, key []byte, now int64) (BNode, error) {
+	newNode := BNode(make([]byte, tree.pageSize))
 	idx := nodeLookupLE(node, key)
 	switch node.btype() {
 	case BNODE_LEAF_TYPE:
-		if idx < node.nkeys() && bytes.Equal(node.getKey(idx), key) {
-			leafDelete(newNode, node, idx)
-			return newNode
+		if idx < node.nkeys() && node.cmpKey(idx, key) == 0 && !node.expired(idx, now) {
+			if err := tree.leafFree(node, idx); err != nil {
+				return nil, err
+			}
+			leafDelete(newNode, node, idx, tree.pageSize)
+			return newNode, nil
 		}
-		return BNode{}
+		return BNode{}, nil
 	case BNODE_NODE_TYPE:
-		return nodeDelete(tree, node, idx, key)
+		return nodeDelete(tree, node, idx, key, now)
 	default:
-		return BNode{}
+		return BNode{}, nil
 	}
 }
 
-func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
+func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte, now int64) (BNode, error) {
 	kptr := node.getPtr(idx)
-	updated := treeDelete(tree, BNode(tree.get(kptr)), key)
+	kid, err := tree.node(kptr)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := treeDelete(tree, kid, key, now)
+	if err != nil {
+		return nil, err
+	}
 	if len(updated) == 0 {
-		return BNode{}
+		return BNode{}, nil
+	}
+	if err := tree.del(kptr); err != nil {
+		return nil, err
+	}
+	newNode := BNode(make([]byte, tree.pageSize))
+	mergeDir, sibling, err := shouldMerge(tree, node, idx, updated)
+	if err != nil {
+		return nil, err
 	}
-	tree.del(kptr)
-	newNode := BNode(make([]byte, BTREE_PAGE_SIZE))
-	mergeDir, sibling := shouldMerge(tree, node, idx, updated)
 	switch {
 	case mergeDir < 0:
-		merged := BNode(make([]byte, BTREE_PAGE_SIZE))
-		nodeMerge(merged, sibling, updated)
-		tree.del(node.getPtr(idx - 1))
-		nodeReplace2Kid(newNode, node, idx-1, tree.new(merged[:BTREE_PAGE_SIZE]), merged.getKey(0))
+		merged := BNode(make([]byte, tree.pageSize))
+		nodeMerge(merged, sibling, updated, tree.pageSize)
+		if err := tree.del(node.getPtr(idx - 1)); err != nil {
+			return nil, err
+		}
+		ptr, err := tree.new(merged[:tree.pageSize])
+		if err != nil {
+			return nil, err
+		}
+		nodeReplace2Kid(newNode, node, idx-1, ptr, merged.getKey(0), nodeCount(merged), tree.pageSize)
 	case mergeDir > 0:
-		merged := BNode(make([]byte, BTREE_PAGE_SIZE))
-		nodeMerge(merged, updated, sibling)
-		tree.del(node.getPtr(idx + 1))
-		nodeReplace2Kid(newNode, node, idx, tree.new(merged[:BTREE_PAGE_SIZE]), merged.getKey(0))
+		merged := BNode(make([]byte, tree.pageSize))
+		nodeMerge(merged, updated, sibling, tree.pageSize)
+		if err := tree.del(node.getPtr(idx + 1)); err != nil {
+			return nil, err
+		}
+		ptr, err := tree.new(merged[:tree.pageSize])
+		if err != nil {
+			return nil, err
+		}
+		nodeReplace2Kid(newNode, node, idx, ptr, merged.getKey(0), nodeCount(merged), tree.pageSize)
 	case mergeDir == 0 && updated.nkeys() == 0:
 		newNode.setHeader(BNODE_NODE_TYPE, 0)
 	case mergeDir == 0 && updated.nkeys() > 0:
-		nodeReplaceKidN(tree, newNode, node, idx, updated)
+		if err := nodeReplaceKidN(tree, newNode, node, idx, updated); err != nil {
+			return nil, err
+		}
 	}
-	return newNode
+	return newNode, nil
 }
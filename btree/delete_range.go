@@ -0,0 +1,194 @@
+package btree
+
+import "bytes"
+
+// DeleteRange deletes the keys in [start, end), a nil bound being open, and
+// returns how many there were. A child whose whole key range is covered is
+// unlinked from its parent and its pages go to the free list without being
+// rewritten; only the nodes on the paths to the two bounds are rebuilt.
+// Nodes left small are not merged, and a root left with a single child
+// gives way to it.
+func (tree *BTree) DeleteRange(start []byte, end []byte) (int, error) {
+	var n int
+	err := tree.freeAfter(func() (err error) {
+		n, err = tree.deleteRange(start, end)
+		return err
+	})
+	return n, err
+}
+
+func (tree *BTree) deleteRange(start []byte, end []byte) (int, error) {
+	if tree.root == 0 {
+		return 0, nil
+	}
+	root, err := tree.node(tree.root)
+	if err != nil {
+		return 0, err
+	}
+	kids, count, changed, err := treeDeleteRange(tree, root, start, end, nil)
+	if err != nil || !changed {
+		return 0, err
+	}
+	if err := tree.del(tree.root); err != nil {
+		return 0, err
+	}
+	if len(kids) == 0 {
+		tree.root = 0
+		return count, nil
+	}
+	for len(kids) == 1 && kids[0].btype() == BNODE_NODE_TYPE && kids[0].nkeys() == 1 {
+		ptr := kids[0].getPtr(0)
+		kid, err := tree.node(ptr)
+		if err != nil {
+			return 0, err
+		}
+		if kid.btype() == BNODE_NODE_TYPE && kid.nkeys() == 1 {
+			if err := tree.del(ptr); err != nil {
+				return 0, err
+			}
+			kids[0] = kid
+			continue
+		}
+		tree.root = ptr
+		return count, nil
+	}
+	return count, tree.setRoot(kids)
+}
+
+// treeDeleteRange returns the nodes that replace node, none if it is left
+// empty, the number of keys deleted under it, and whether anything was.
+// hi is the first key past node, nil at the right edge.
+func treeDeleteRange(tree *BTree, node BNode, start, end, hi []byte) ([]BNode, int, bool, error) {
+	if node.btype() == BNODE_LEAF_TYPE {
+		return leafDeleteRange(tree, node, start, end)
+	}
+	type kid struct {
+		key []byte
+		ptr uint64
+		val []byte
+	}
+	var kept []kid
+	count, changed := 0, false
+	for i := uint16(0); i < node.nkeys(); i++ {
+		ptr := node.getPtr(i)
+		kidHi := hi
+		if i+1 < node.nkeys() {
+			kidHi = node.getKey(i + 1)
+		}
+		switch {
+		case end != nil && node.cmpKey(i, end) >= 0,
+			start != nil && kidHi != nil && bytes.Compare(kidHi, start) <= 0:
+			kept = append(kept, kid{node.getKey(i), ptr, node.getVal(i)})
+		case node.cmpKey(i, nil) != 0 && (start == nil || node.cmpKey(i, start) >= 0) &&
+			(end == nil || kidHi != nil && bytes.Compare(kidHi, end) <= 0):
+			// the leftmost child holds the empty key and is never dropped
+			n, err := treeFree(tree, ptr)
+			if err != nil {
+				return nil, 0, false, err
+			}
+			count += n
+			changed = true
+		default:
+			knode, err := tree.node(ptr)
+			if err != nil {
+				return nil, 0, false, err
+			}
+			split, n, kchanged, err := treeDeleteRange(tree, knode, start, end, kidHi)
+			if err != nil {
+				return nil, 0, false, err
+			}
+			if !kchanged {
+				kept = append(kept, kid{node.getKey(i), ptr, node.getVal(i)})
+				continue
+			}
+			count += n
+			changed = true
+			if err := tree.del(ptr); err != nil {
+				return nil, 0, false, err
+			}
+			for _, nd := range split {
+				kptr, err := tree.new(nd)
+				if err != nil {
+					return nil, 0, false, err
+				}
+				kept = append(kept, kid{nd.getKey(0), kptr, countVal(nodeCount(nd))})
+			}
+		}
+	}
+	if !changed || len(kept) == 0 {
+		return nil, count, changed, nil
+	}
+	// a rebuilt child may start with a longer key than the one it replaces
+	n := uint16(len(kept))
+	newNode := BNode(make([]byte, 4*tree.pageSize))
+	newNode.setHeader(BNODE_NODE_TYPE, n)
+	newNode.setPrefix(nodePrefix(kept[0].key, kept[n-1].key, n, tree.pageSize))
+	for i, k := range kept {
+		nodeAppendKV(newNode, uint16(i), k.ptr, k.key, k.val)
+	}
+	return nodeSplit(newNode, tree.pageSize), count, true, nil
+}
+
+func leafDeleteRange(tree *BTree, node BNode, start, end []byte) ([]BNode, int, bool, error) {
+	n := node.nkeys()
+	lo := uint16(0)
+	for lo < n && (node.cmpKey(lo, nil) == 0 || start != nil && node.cmpKey(lo, start) < 0) {
+		lo++
+	}
+	hi := lo
+	for hi < n && (end == nil || node.cmpKey(hi, end) < 0) {
+		hi++
+	}
+	if lo == hi {
+		return nil, 0, false, nil
+	}
+	for i := lo; i < hi; i++ {
+		if err := tree.leafFree(node, i); err != nil {
+			return nil, 0, false, err
+		}
+		tree.changed(EVENT_DEL, node.getKey(i), nil)
+	}
+	left := n - (hi - lo)
+	if left == 0 {
+		return nil, int(hi - lo), true, nil
+	}
+	first, last := uint16(0), n-1
+	if lo == 0 {
+		first = hi
+	}
+	if hi == n {
+		last = lo - 1
+	}
+	newNode := BNode(make([]byte, tree.pageSize))
+	newNode.setHeader(BNODE_LEAF_TYPE, left)
+	newNode.setPrefix(nodePrefix(node.getKey(first), node.getKey(last), left, tree.pageSize))
+	nodeAppendRange(newNode, node, 0, 0, lo)
+	nodeAppendRange(newNode, node, lo, hi, n-hi)
+	return []BNode{newNode}, int(hi - lo), true, nil
+}
+
+// treeFree releases a subtree that is being dropped whole, overflow chains
+// included, and returns the number of keys it held.
+func treeFree(tree *BTree, ptr uint64) (int, error) {
+	node, err := tree.node(ptr)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for i := uint16(0); i < node.nkeys(); i++ {
+		if node.btype() == BNODE_LEAF_TYPE {
+			if err := tree.leafFree(node, i); err != nil {
+				return 0, err
+			}
+			tree.changed(EVENT_DEL, node.getKey(i), nil)
+			count++
+			continue
+		}
+		n, err := treeFree(tree, node.getPtr(i))
+		if err != nil {
+			return 0, err
+		}
+		count += n
+	}
+	return count, tree.del(ptr)
+}
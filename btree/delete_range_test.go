@@ -0,0 +1,145 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestDeleteRange(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compress=%v", compress), func(t *testing.T) {
+			kv := KV{Compress: compress}
+			openKV(t, &kv)
+			defer kv.Close()
+			r := rand.New(rand.NewSource(1))
+			model := map[string]string{}
+			fill := func(n int) {
+				tx, err := kv.Begin()
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i := 0; i < n; i++ {
+					k := fmt.Sprintf("k%06d", r.Intn(100000))
+					v := fmt.Sprint(i)
+					if r.Intn(300) == 0 {
+						v = string(bytes.Repeat([]byte("O"), 6000))
+					}
+					if err := tx.Set([]byte(k), []byte(v)); err != nil {
+						t.Fatal(err)
+					}
+					model[k] = v
+				}
+				if err := tx.Commit(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			fill(5000)
+			bound := func() []byte {
+				if r.Intn(8) == 0 {
+					return nil
+				}
+				return []byte(fmt.Sprintf("k%06d", r.Intn(105000)))
+			}
+			for i := 0; i < 30; i++ {
+				start, end := bound(), bound()
+				if start != nil && end != nil && bytes.Compare(start, end) > 0 {
+					start, end = end, start
+				}
+				want := 0
+				for k := range model {
+					if (start == nil || k >= string(start)) && (end == nil || k < string(end)) {
+						delete(model, k)
+						want++
+					}
+				}
+				n, err := kv.DeleteRange(start, end)
+				if err != nil || n != want {
+					t.Fatalf("[%q, %q): %d deleted, want %d: %v", start, end, n, want, err)
+				}
+				checkTree(t, &kv.tree)
+				if i%10 == 0 {
+					checkModel(t, &kv, model)
+					fill(500)
+				}
+			}
+			checkModel(t, &kv, model)
+			kv.Close()
+			openKV(t, &kv)
+			checkModel(t, &kv, model)
+		})
+	}
+}
+
+// Deleting everything hands every page of the tree to the free list in
+// the same commit.
+func TestDeleteRangeFreesEveryPage(t *testing.T) {
+	kv := KV{}
+	openKV(t, &kv)
+	defer kv.Close()
+	fillKV(t, &kv, 5000)
+	pages := 0
+	var walk func(ptr uint64)
+	walk = func(ptr uint64) {
+		pages++
+		node, err := kv.tree.node(ptr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if node.btype() == BNODE_NODE_TYPE {
+			for i := uint16(0); i < node.nkeys(); i++ {
+				walk(node.getPtr(i))
+			}
+		}
+	}
+	walk(kv.tree.root)
+	free := func() int {
+		n := 0
+		if err := kv.free.visit(func(uint64) {}, func(uint64) { n++ }); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	before := free()
+	n, err := kv.DeleteRange(nil, nil)
+	if err != nil || n != 5000 {
+		t.Fatalf("%d deleted: %v", n, err)
+	}
+	// less the page taken for the new, empty root
+	if got := free() - before; got < pages-1 {
+		t.Fatalf("%d pages freed of the %d in the tree", got, pages)
+	}
+	checkModel(t, &kv, map[string]string{})
+}
+
+func TestTxDeleteRange(t *testing.T) {
+	kv := KV{}
+	openKV(t, &kv)
+	defer kv.Close()
+	model := fillKV(t, &kv, 1000)
+	tx, err := kv.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Set(testKey(2000), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	n, err := tx.DeleteRange(testKey(100), testKey(5000))
+	if err != nil || n != 901 {
+		t.Fatalf("%d deleted: %v", n, err)
+	}
+	if _, ok, err := tx.Get(testKey(2000)); err != nil || ok {
+		t.Fatalf("the tx still sees its own write: %v", err)
+	}
+	if _, ok, err := kv.Get(testKey(500)); err != nil || !ok {
+		t.Fatalf("others see the uncommitted delete: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 100; i < 1000; i++ {
+		delete(model, string(testKey(i)))
+	}
+	checkModel(t, &kv, model)
+}
@@ -49,18 +49,20 @@ func Demo() string {
 	nodeAppendKV(l2, 1, 0, []byte("t"), []byte("20"))
 	id2 := p.New(l2[:BTREE_PAGE_SIZE])
 
-	// internal root (tutorial’s variant): keys=first keys of children; ptrs=child pages
+	// internal root (tutorial’s variant): keys=first keys of children; ptrs=child pages;
+	// vals=key counts of children
 	root := BNode(make([]byte, BTREE_PAGE_SIZE))
 	root.setHeader(BNODE_NODE_TYPE, 2)
-	nodeAppendKV(root, 0, id1, l1.getKey(0), nil)
-	nodeAppendKV(root, 1, id2, l2.getKey(0), nil)
+	nodeAppendKV(root, 0, id1, l1.getKey(0), countVal(2))
+	nodeAppendKV(root, 1, id2, l2.getKey(0), countVal(2))
 	rootID := p.New(root[:BTREE_PAGE_SIZE])
 
 	tree := &BTree{
-		root: rootID,
-		get:  func(id uint64) []byte { return p.Get(id) },
-		new:  func(b []byte) uint64 { return p.New(b) },
-		del:  func(id uint64) { p.Del(id) },
+		root:     rootID,
+		pageSize: BTREE_PAGE_SIZE,
+		get:      func(id uint64) ([]byte, error) { return p.Get(id), nil },
+		new:      func(b []byte) (uint64, error) { return p.New(b), nil },
+		del:      func(id uint64) error { p.Del(id); return nil },
 	}
 
 	fmt.Fprintln(&out, "\n=== Whole Tree ===")
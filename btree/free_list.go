@@ -5,7 +5,11 @@ import "encoding/binary"
 type LNode []byte
 
 const FREE_LIST_HEADER = 8
-const FREE_LIST_CAP = (BTREE_PAGE_SIZE - FREE_LIST_HEADER) / 8
+
+// FreeListCap is the number of pointers held by one free list page.
+func FreeListCap(pageSize int) int {
+	return (nodeCap(pageSize) - FREE_LIST_HEADER) / 8
+}
 
 func (node LNode) getNext() uint64 {
 	return binary.LittleEndian.Uint64(node[:8])
@@ -23,70 +27,123 @@ func (node LNode) setPtr(idx int, ptr uint64) {
 }
 
 type FreeList struct {
-	get      func(uint64) []byte
-	new      func([]byte) uint64
-	set      func(uint64) []byte
+	get      func(uint64) ([]byte, error)
+	new      func([]byte) (uint64, error)
+	set      func(uint64) ([]byte, error)
 	headPage uint64
 	headSeq  uint64
 	tailPage uint64
 	tailSeq  uint64
 	maxSeq   uint64
+	pageSize int
+	// extents is set when entries are variable-sized extents, which may be
+	// too small to hold a list node, so nodes are always appended.
+	extents bool
 }
 
-func seq2idx(seq uint64) int {
-	return int(seq % FREE_LIST_CAP)
+func (fl *FreeList) seq2idx(seq uint64) int {
+	return int(seq % uint64(FreeListCap(fl.pageSize)))
 }
 
 func (fl *FreeList) SetMaxSeq() {
 	fl.maxSeq = fl.tailSeq
 }
 
-func flPop(fl *FreeList) (uint64, uint64) {
+func flPop(fl *FreeList) (uint64, uint64, error) {
 	if fl.headSeq == fl.maxSeq {
-		return 0, 0
+		return 0, 0, nil
 	}
-	node := LNode(fl.get(fl.headPage))
-	ptr := node.getPtr(seq2idx(fl.headSeq))
+	page, err := fl.get(fl.headPage)
+	if err != nil {
+		return 0, 0, err
+	}
+	node := LNode(page)
+	ptr := node.getPtr(fl.seq2idx(fl.headSeq))
 	fl.headSeq++
-	if seq2idx(fl.headSeq) == 0 {
+	if fl.seq2idx(fl.headSeq) == 0 {
 		head := fl.headPage
 		fl.headPage = node.getNext()
-		return ptr, head
+		return ptr, head, nil
 	}
-	return ptr, 0
+	return ptr, 0, nil
 }
 
-func (fl *FreeList) PopHead() uint64 {
-	ptr, head := flPop(fl)
+func (fl *FreeList) PopHead() (uint64, error) {
+	ptr, head, err := flPop(fl)
+	if err != nil {
+		return 0, err
+	}
 	if head != 0 {
-		fl.PushTail(head)
+		if err := fl.PushTail(head); err != nil {
+			return 0, err
+		}
 	}
-	return ptr
+	return ptr, nil
 }
 
-func (fl *FreeList) PushTail(ptr uint64) {
-	LNode(fl.set(fl.tailPage)).setPtr(seq2idx(fl.tailSeq), ptr)
+func (fl *FreeList) PushTail(ptr uint64) error {
+	tail, err := fl.set(fl.tailPage)
+	if err != nil {
+		return err
+	}
+	LNode(tail).setPtr(fl.seq2idx(fl.tailSeq), ptr)
 	fl.tailSeq++
-	if seq2idx(fl.tailSeq) == 0 {
-		next, head := flPop(fl)
+	if fl.seq2idx(fl.tailSeq) == 0 {
+		var next, head uint64
+		if !fl.extents {
+			if next, head, err = flPop(fl); err != nil {
+				return err
+			}
+		}
 		if next == 0 {
-			next = fl.new(make([]byte, BTREE_PAGE_SIZE))
+			if next, err = fl.new(make([]byte, fl.pageSize)); err != nil {
+				return err
+			}
 		}
-		LNode(fl.set(fl.tailPage)).setNext(next)
+		LNode(tail).setNext(next)
 		fl.tailPage = next
 		if head != 0 {
-			LNode(fl.set(fl.tailPage)).setPtr(0, head)
+			if tail, err = fl.set(fl.tailPage); err != nil {
+				return err
+			}
+			LNode(tail).setPtr(0, head)
 			fl.tailSeq++
 		}
 	}
+	return nil
 }
 
-func (fl *FreeList) PopHeadLe(max uint64) uint64 {
+func (fl *FreeList) PopHeadLe(max uint64) (uint64, error) {
 	old := fl.maxSeq
 	if max < old {
 		fl.maxSeq = max
 	}
-	ptr := fl.PopHead()
+	ptr, err := fl.PopHead()
 	fl.maxSeq = old
-	return ptr
+	return ptr, err
+}
+
+// visit calls node with every page of the list and entry with every
+// pointer held in it, in list order.
+func (fl *FreeList) visit(node func(uint64), entry func(uint64)) error {
+	ptr := fl.headPage
+	node(ptr)
+	page, err := fl.get(ptr)
+	if err != nil {
+		return err
+	}
+	for seq := fl.headSeq; seq < fl.tailSeq; seq++ {
+		if seq != fl.headSeq && fl.seq2idx(seq) == 0 {
+			ptr = LNode(page).getNext()
+			node(ptr)
+			if page, err = fl.get(ptr); err != nil {
+				return err
+			}
+		}
+		entry(LNode(page).getPtr(fl.seq2idx(seq)))
+	}
+	if ptr != fl.tailPage {
+		node(fl.tailPage)
+	}
+	return nil
 }
@@ -1,21 +1,41 @@
 package btree
 
-import "bytes"
+import "time"
 
-func (tree *BTree) Get(key []byte) ([]byte, bool) {
-	if tree.root == 0 {
-		return nil, false
+// Get returns the value of key. A key past its expiry time is not found,
+// though it may still be in the tree.
+func (tree *BTree) Get(key []byte) ([]byte, bool, error) {
+	node, idx, ok, err := tree.lookup(key)
+	if err != nil || !ok || node.expired(idx, time.Now().UnixNano()) {
+		return nil, false, err
+	}
+	val, err := tree.leafVal(node, idx)
+	if err != nil {
+		return nil, false, err
+	}
+	return val, true, nil
+}
+
+// lookup finds the leaf cell holding key.
+func (tree *BTree) lookup(key []byte) (BNode, uint16, bool, error) {
+	if tree.root == 0 || len(key) == 0 {
+		return nil, 0, false, nil
+	}
+	node, err := tree.node(tree.root)
+	if err != nil {
+		return nil, 0, false, err
 	}
-	node := BNode(tree.get(tree.root))
 	for {
 		idx := nodeLookupLE(node, key)
 		if node.btype() == BNODE_LEAF_TYPE {
-			if idx > 0 && bytes.Equal(node.getKey(idx), key) {
-				return node.getVal(idx), true
+			if node.cmpKey(idx, key) == 0 {
+				return node, idx, true, nil
 			}
-			return nil, false
+			return nil, 0, false, nil
+		}
+		node, err = tree.node(node.getPtr(idx))
+		if err != nil {
+			return nil, 0, false, err
 		}
-		ptr := node.getPtr(idx)
-		node = BNode(tree.get(ptr))
 	}
 }
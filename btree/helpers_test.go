@@ -0,0 +1,126 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// openKV opens kv, in a temporary directory unless it has a path.
+func openKV(t *testing.T, kv *KV) {
+	t.Helper()
+	if kv.Path == "" {
+		kv.Path = filepath.Join(t.TempDir(), "test.db")
+	}
+	if err := kv.Open(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeAt overwrites the data file of kv at off.
+func writeAt(t *testing.T, kv *KV, off int64, data []byte) {
+	t.Helper()
+	f, err := os.OpenFile(kv.Path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt(data, off); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testKey(i int) []byte {
+	return []byte(fmt.Sprintf("k%05d", i))
+}
+
+// checkModel compares the whole content of kv with model, through Get and
+// Scan.
+func checkModel(t *testing.T, kv *KV, model map[string]string) {
+	t.Helper()
+	keys := make([]string, 0, len(model))
+	for k := range model {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var got []string
+	err := kv.Scan(nil, nil, func(k, v []byte) bool {
+		if model[string(k)] != string(v) {
+			t.Fatalf("scan: %q has the wrong value", k)
+		}
+		got = append(got, string(k))
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(keys) {
+		t.Fatalf("scan: %d keys, want %d", len(got), len(keys))
+	}
+	for i := range got {
+		if got[i] != keys[i] {
+			t.Fatalf("scan: %q at %d, want %q", got[i], i, keys[i])
+		}
+	}
+	for _, k := range keys {
+		v, ok, err := kv.Get([]byte(k))
+		if err != nil || !ok || !bytes.Equal(v, []byte(model[k])) {
+			t.Fatalf("get %q: %v %v", k, ok, err)
+		}
+	}
+}
+
+// checkTree walks the whole tree and checks that its leaves are at one
+// depth and in key order, that nodes fit their pages, and that each
+// internal cell holds the first key and the key count of its child.
+func checkTree(t *testing.T, tree *BTree) {
+	t.Helper()
+	depth := -1
+	var prev []byte
+	var walk func(ptr uint64, d int, first []byte) uint64
+	walk = func(ptr uint64, d int, first []byte) uint64 {
+		node, err := tree.node(ptr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if node.nkeys() == 0 {
+			t.Fatalf("page %d: empty node", ptr)
+		}
+		if first != nil && !bytes.Equal(node.getKey(0), first) {
+			t.Fatalf("page %d: starts with %q, its parent says %q", ptr, node.getKey(0), first)
+		}
+		if int(node.nbytes()) > nodeCap(tree.pageSize) {
+			t.Fatalf("page %d: node of %d bytes", ptr, node.nbytes())
+		}
+		if node.btype() == BNODE_LEAF_TYPE {
+			if depth == -1 {
+				depth = d
+			} else if depth != d {
+				t.Fatalf("page %d: leaf at depth %d, not %d", ptr, d, depth)
+			}
+			for i := uint16(0); i < node.nkeys(); i++ {
+				key := node.getKey(i)
+				if prev != nil && bytes.Compare(key, prev) <= 0 {
+					t.Fatalf("page %d: %q after %q", ptr, key, prev)
+				}
+				prev = key
+			}
+			return uint64(node.nkeys())
+		}
+		var sum uint64
+		for i := uint16(0); i < node.nkeys(); i++ {
+			n := walk(node.getPtr(i), d+1, node.getKey(i))
+			if n != node.getCount(i) {
+				t.Fatalf("page %d: child %d holds %d keys, not %d", ptr, i, n, node.getCount(i))
+			}
+			sum += n
+		}
+		return sum
+	}
+	if tree.root != 0 {
+		walk(tree.root, 0, nil)
+	}
+}
@@ -1,6 +1,6 @@
 package btree
 
-import "bytes"
+import "time"
 
 type iterFrame struct {
 	ptr uint64
@@ -8,31 +8,52 @@ type iterFrame struct {
 }
 
 type Iter struct {
-	tree  *BTree
-	stack []iterFrame
-	leaf  BNode
-	idx   int
-	end   []byte
-	ok    bool
+	tree    *BTree // nil if made by a closed Tx
+	stack   []iterFrame
+	leaf    BNode
+	leafPtr uint64
+	pinned  bool
+	idx     int
+	start   []byte
+	end     []byte
+	now     int64 // keys expired by then are skipped
+	ok      bool
+	err     error
 }
 
 func NewIter(t *BTree) *Iter {
 	return &Iter{tree: t}
 }
 
+// SeekGE positions the iterator on the first key >= start. Next stops
+// before end and Prev stops below start; a nil bound is open.
 func (it *Iter) SeekGE(start []byte, end []byte) bool {
+	it.now = time.Now().UnixNano()
+	it.seekGE(start, end)
+	return it.live(it.next)
+}
+
+func (it *Iter) seekGE(start []byte, end []byte) bool {
 	it.stack = it.stack[:0]
+	it.start = start
 	it.end = end
+	if it.tree == nil {
+		return false
+	}
+	it.err = nil
 	if it.tree.root == 0 {
 		it.ok = false
 		return false
 	}
 	ptr := it.tree.root
 	for {
-		n := BNode(it.tree.get(ptr))
+		n, err := it.tree.node(ptr)
+		if err != nil {
+			return it.fail(err)
+		}
 		if n.btype() == BNODE_LEAF_TYPE {
 			idx := int(nodeLookupLE(n, start))
-			if idx > 0 && bytes.Compare(n.getKey(uint16(idx)), start) >= 0 {
+			if len(start) > 0 && n.cmpKey(uint16(idx), start) == 0 {
 				it.idx = idx
 			} else {
 				it.idx = idx + 1
@@ -41,9 +62,9 @@ func (it *Iter) SeekGE(start []byte, end []byte) bool {
 				it.ok = it.advance()
 				return it.ok
 			}
-			it.leaf = n
+			it.setLeaf(ptr, n)
 			it.ok = true
-			if it.end != nil && bytes.Compare(it.leaf.getKey(uint16(it.idx)), it.end) >= 0 {
+			if it.end != nil && it.leaf.cmpKey(uint16(it.idx), it.end) >= 0 {
 				it.ok = false
 			}
 			return it.ok
@@ -54,31 +75,90 @@ func (it *Iter) SeekGE(start []byte, end []byte) bool {
 	}
 }
 
+// SeekLE positions the iterator on the last key <= key, or on the last key
+// of the tree when key is nil. Prev stops below start; Next is unbounded.
+func (it *Iter) SeekLE(key []byte, start []byte) bool {
+	it.now = time.Now().UnixNano()
+	it.seekLE(key, start)
+	return it.live(it.prev)
+}
+
+func (it *Iter) seekLE(key []byte, start []byte) bool {
+	it.stack = it.stack[:0]
+	it.start = start
+	it.end = nil
+	if it.tree == nil {
+		return false
+	}
+	it.err = nil
+	if it.tree.root == 0 {
+		it.ok = false
+		return false
+	}
+	ptr := it.tree.root
+	for {
+		n, err := it.tree.node(ptr)
+		if err != nil {
+			return it.fail(err)
+		}
+		idx := int(n.nkeys()) - 1
+		if key != nil {
+			idx = int(nodeLookupLE(n, key))
+		}
+		if n.btype() == BNODE_LEAF_TYPE {
+			if idx < 0 {
+				it.ok = it.retreat()
+				return it.ok
+			}
+			it.setLeaf(ptr, n)
+			it.idx = idx
+			it.ok = it.aboveStart()
+			return it.ok
+		}
+		it.stack = append(it.stack, iterFrame{ptr: ptr, idx: idx})
+		ptr = n.getPtr(uint16(idx))
+	}
+}
+
 func (it *Iter) Key() []byte {
 	if !it.ok {
 		return nil
 	}
-	return it.leaf.getKey(uint16(it.idx))
+	return it.tree.own(it.leaf.getKey(uint16(it.idx)))
 }
 
 func (it *Iter) Val() []byte {
 	if !it.ok {
 		return nil
 	}
-	return it.leaf.getVal(uint16(it.idx))
+	val, err := it.tree.leafVal(it.leaf, uint16(it.idx))
+	if err != nil {
+		it.fail(err)
+		return nil
+	}
+	return val
 }
 
 func (it *Iter) Valid() bool {
 	return it.ok
 }
 
+func (it *Iter) Err() error {
+	return it.err
+}
+
 func (it *Iter) Next() bool {
+	it.next()
+	return it.live(it.next)
+}
+
+func (it *Iter) next() bool {
 	if !it.ok {
 		return false
 	}
 	it.idx++
 	if it.idx < int(it.leaf.nkeys()) {
-		if it.end != nil && bytes.Compare(it.leaf.getKey(uint16(it.idx)), it.end) >= 0 {
+		if it.end != nil && it.leaf.cmpKey(uint16(it.idx), it.end) >= 0 {
 			it.ok = false
 			return false
 		}
@@ -94,20 +174,26 @@ func (it *Iter) advance() bool {
 			return false
 		}
 		top := it.stack[len(it.stack)-1]
-		parent := BNode(it.tree.get(top.ptr))
+		parent, err := it.tree.node(top.ptr)
+		if err != nil {
+			return it.fail(err)
+		}
 		i := top.idx + 1
 		if i < int(parent.nkeys()) {
 			it.stack[len(it.stack)-1].idx = i
 			ptr := parent.getPtr(uint16(i))
 			for {
-				n := BNode(it.tree.get(ptr))
+				n, err := it.tree.node(ptr)
+				if err != nil {
+					return it.fail(err)
+				}
 				if n.btype() == BNODE_LEAF_TYPE {
-					it.leaf = n
-					it.idx = 1
+					it.setLeaf(ptr, n)
+					it.idx = 0
 					if it.idx >= int(n.nkeys()) {
 						break
 					}
-					if it.end != nil && bytes.Compare(it.leaf.getKey(uint16(it.idx)), it.end) >= 0 {
+					if it.end != nil && it.leaf.cmpKey(uint16(it.idx), it.end) >= 0 {
 						return false
 					}
 					return true
@@ -120,3 +206,104 @@ func (it *Iter) advance() bool {
 		}
 	}
 }
+
+func (it *Iter) Prev() bool {
+	it.prev()
+	return it.live(it.prev)
+}
+
+// prev moves to the previous key, walking back up the frame stack when it
+// leaves the first key of a leaf.
+func (it *Iter) prev() bool {
+	if !it.ok {
+		return false
+	}
+	if it.idx > 0 {
+		it.idx--
+		it.ok = it.aboveStart()
+		return it.ok
+	}
+	it.ok = it.retreat()
+	return it.ok
+}
+
+// aboveStart reports whether the current key is in range going backwards.
+// The empty key leading the leftmost leaf is not a real key.
+func (it *Iter) aboveStart() bool {
+	if it.leaf.cmpKey(uint16(it.idx), nil) == 0 {
+		return false
+	}
+	return it.start == nil || it.leaf.cmpKey(uint16(it.idx), it.start) >= 0
+}
+
+func (it *Iter) retreat() bool {
+	for {
+		if len(it.stack) == 0 {
+			return false
+		}
+		top := it.stack[len(it.stack)-1]
+		i := top.idx - 1
+		if i < 0 {
+			it.stack = it.stack[:len(it.stack)-1]
+			continue
+		}
+		parent, err := it.tree.node(top.ptr)
+		if err != nil {
+			return it.fail(err)
+		}
+		it.stack[len(it.stack)-1].idx = i
+		ptr := parent.getPtr(uint16(i))
+		for {
+			n, err := it.tree.node(ptr)
+			if err != nil {
+				return it.fail(err)
+			}
+			last := int(n.nkeys()) - 1
+			if n.btype() == BNODE_LEAF_TYPE {
+				if last < 0 {
+					break
+				}
+				it.setLeaf(ptr, n)
+				it.idx = last
+				return it.aboveStart()
+			}
+			it.stack = append(it.stack, iterFrame{ptr: ptr, idx: last})
+			ptr = n.getPtr(uint16(last))
+		}
+	}
+}
+
+// live steps on while the iterator is on a key that had expired when it
+// last seeked.
+func (it *Iter) live(step func() bool) bool {
+	for it.ok && it.leaf.expired(uint16(it.idx), it.now) {
+		step()
+	}
+	return it.ok
+}
+
+func (it *Iter) fail(err error) bool {
+	it.err = err
+	it.ok = false
+	return false
+}
+
+func (it *Iter) setLeaf(ptr uint64, n BNode) {
+	if it.tree.pin != nil {
+		it.tree.pin(ptr)
+		if it.pinned {
+			it.tree.unpin(it.leafPtr)
+		}
+		it.pinned = true
+	}
+	it.leaf = n
+	it.leafPtr = ptr
+}
+
+func (it *Iter) Close() {
+	if it.pinned {
+		it.tree.unpin(it.leafPtr)
+		it.pinned = false
+	}
+	it.ok = false
+}
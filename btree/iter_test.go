@@ -0,0 +1,150 @@
+package btree
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"sort"
+	"testing"
+)
+
+// randomKV commits about 2000 random keys and returns them sorted.
+func randomKV(t *testing.T, kv *KV, r *rand.Rand) []string {
+	t.Helper()
+	set := map[string]bool{}
+	tx, err := kv.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3000; i++ {
+		k := fmt.Sprintf("key%05d", r.Intn(20000))
+		set[k] = true
+		if err := tx.Set([]byte(k), make([]byte, r.Intn(100))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for k := range set {
+		if r.Intn(3) == 0 {
+			delete(set, k)
+			if _, err := tx.Del([]byte(k)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestScanReverse(t *testing.T) {
+	kv := KV{}
+	openKV(t, &kv)
+	defer kv.Close()
+	if err := kv.ScanReverse(nil, nil, func(k, v []byte) bool {
+		t.Fatalf("%q in an empty database", k)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	r := rand.New(rand.NewSource(1))
+	keys := randomKV(t, &kv, r)
+	bound := func() []byte {
+		if r.Intn(5) == 0 {
+			return nil
+		}
+		return []byte(fmt.Sprintf("key%05d", r.Intn(21000)))
+	}
+	for i := 0; i < 200; i++ {
+		start, end := bound(), bound()
+		var want []string
+		for j := len(keys) - 1; j >= 0; j-- {
+			k := keys[j]
+			if (start == nil || k >= string(start)) && (end == nil || k < string(end)) {
+				want = append(want, k)
+			}
+		}
+		var got []string
+		if err := kv.ScanReverse(start, end, func(k, v []byte) bool {
+			got = append(got, string(k))
+			return true
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, want) {
+			t.Fatalf("[%q, %q): %d keys, want %d", start, end, len(got), len(want))
+		}
+	}
+}
+
+// Stepping back and forth at random crosses leaf boundaries both ways.
+func TestIterPrevAndNext(t *testing.T) {
+	kv := KV{}
+	openKV(t, &kv)
+	defer kv.Close()
+	r := rand.New(rand.NewSource(2))
+	keys := randomKV(t, &kv, r)
+	it := NewIter(&kv.tree)
+	defer it.Close()
+	target := "key10000x"
+	pos := sort.SearchStrings(keys, target) - 1
+	if !it.SeekLE([]byte(target), nil) || string(it.Key()) != keys[pos] {
+		t.Fatalf("SeekLE(%q) at %q, want %q", target, it.Key(), keys[pos])
+	}
+	for step := 0; step < 5000; step++ {
+		if r.Intn(2) == 0 {
+			ok := it.Next()
+			pos++
+			if ok != (pos < len(keys)) {
+				t.Fatalf("step %d: Next = %v at %d", step, ok, pos)
+			}
+			if !ok {
+				it.SeekLE(nil, nil)
+				pos = len(keys) - 1
+			}
+		} else {
+			ok := it.Prev()
+			pos--
+			if ok != (pos >= 0) {
+				t.Fatalf("step %d: Prev = %v at %d", step, ok, pos)
+			}
+			if !ok {
+				it.SeekGE(nil, nil)
+				pos = 0
+			}
+		}
+		if string(it.Key()) != keys[pos] {
+			t.Fatalf("step %d: at %q, want %q", step, it.Key(), keys[pos])
+		}
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSeekLEStopsAtStart(t *testing.T) {
+	kv := KV{}
+	openKV(t, &kv)
+	defer kv.Close()
+	for _, k := range []string{"a", "c", "e"} {
+		if err := kv.Set([]byte(k), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	it := NewIter(&kv.tree)
+	defer it.Close()
+	if !it.SeekLE([]byte("d"), []byte("b")) || string(it.Key()) != "c" {
+		t.Fatalf("SeekLE(d) at %q", it.Key())
+	}
+	if it.Prev() {
+		t.Fatalf("Prev went below the start to %q", it.Key())
+	}
+	if it.SeekLE([]byte("a"), []byte("b")) {
+		t.Fatalf("SeekLE(a) found %q below the start", it.Key())
+	}
+}
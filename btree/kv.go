@@ -1,47 +1,202 @@
 package btree
 
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Update modes. MODE_CAS writes only when the key holds UpdateReq.Expect.
+const (
+	MODE_UPSERT      = 0
+	MODE_UPDATE_ONLY = 1
+	MODE_INSERT_ONLY = 2
+	MODE_CAS         = 3
+)
+
+type UpdateReq struct {
+	Key    []byte
+	Val    []byte
+	Mode   int
+	Expect []byte
+	// set by Update
+	Applied bool   // the value was written
+	Added   bool   // the key was not there before
+	Old     []byte // the value before the update, nil if absent
+}
+
 func (tree *BTree) Insert(key []byte, val []byte) error {
-	if err := checkLimit(key, val); err != nil {
+	return tree.insert(key, val, 0)
+}
+
+// insert stores the expiry time after the value when it is not zero.
+func (tree *BTree) insert(key []byte, val []byte, expires int64) error {
+	return tree.freeAfter(func() error {
+		return tree.put(key, val, expires, nil)
+	})
+}
+
+// put writes key, or with a req, lets the leaf that holds the key decide
+// whether the write applies and fills in req.
+func (tree *BTree) put(key []byte, val []byte, expires int64, req *UpdateReq) error {
+	if err := tree.checkLimit(key, val); err != nil {
 		return err
 	}
 	if tree.root == 0 {
-		root := BNode(make([]byte, BTREE_PAGE_SIZE))
+		if req != nil && !req.allows(false) {
+			return nil
+		}
+		cell, flags, err := tree.cellVal(val, expires)
+		if err != nil {
+			return err
+		}
+		root := BNode(make([]byte, tree.pageSize))
 		root.setHeader(BNODE_LEAF_TYPE, 2)
 		nodeAppendKV(root, 0, 0, nil, nil)
-		nodeAppendKV(root, 1, 0, key, val)
-		tree.root = tree.new(root[:BTREE_PAGE_SIZE])
-		return nil
-	}
-	node := treeInsert(tree, BNode(tree.get(tree.root)), key, val)
-	nsplit, split := nodeSplit3(node)
-	tree.del(tree.root)
-	if nsplit > 1 {
-		root := BNode(make([]byte, BTREE_PAGE_SIZE))
-		root.setHeader(BNODE_NODE_TYPE, nsplit)
-		for i, knode := range split[:nsplit] {
-			ptr, k := tree.new(knode[:BTREE_PAGE_SIZE]), knode.getKey(0)
-			nodeAppendKV(root, uint16(i), ptr, k, nil)
-		}
-		tree.root = tree.new(root[:BTREE_PAGE_SIZE])
+		nodeAppendCell(root, 1, 0, key, cell, flags)
+		ptr, err := tree.new(root[:tree.pageSize])
+		if err != nil {
+			return err
+		}
+		tree.root = ptr
 	} else {
-		tree.root = tree.new(split[0][:BTREE_PAGE_SIZE])
+		rootNode, err := tree.node(tree.root)
+		if err != nil {
+			return err
+		}
+		node, err := treeInsert(tree, rootNode, key, val, expires, req)
+		if err != nil || node == nil {
+			return err
+		}
+		if err := tree.del(tree.root); err != nil {
+			return err
+		}
+		if err := tree.setRoot(nodeSplit(node, tree.pageSize)); err != nil {
+			return err
+		}
+	}
+	if req != nil {
+		req.Applied = true
+	}
+	tree.changed(EVENT_PUT, key, val)
+	return nil
+}
+
+// cellVal is what a leaf cell stores for val: the value itself or a
+// reference to its overflow pages, then the expiry time if it has one.
+func (tree *BTree) cellVal(val []byte, expires int64) ([]byte, uint16, error) {
+	var flags uint16
+	if len(val) > maxValSize(tree.pageSize) {
+		ref, err := overflowWrite(tree, val)
+		if err != nil {
+			return nil, 0, err
+		}
+		val, flags = ref, VAL_OVERFLOW
+	}
+	if expires != 0 {
+		val = binary.LittleEndian.AppendUint64(val[:len(val):len(val)], uint64(expires))
+		flags |= VAL_EXPIRES
 	}
+	return val, flags, nil
+}
+
+// setRoot stores the nodes that replace the root, adding levels on top
+// while there is more than one.
+func (tree *BTree) setRoot(split []BNode) error {
+	// the root keeps the empty sentinel key, so it never has a prefix
+	for len(split) > 1 {
+		root := BNode(make([]byte, 4*tree.pageSize))
+		root.setHeader(BNODE_NODE_TYPE, uint16(len(split)))
+		for i, knode := range split {
+			ptr, err := tree.new(knode[:tree.pageSize])
+			if err != nil {
+				return err
+			}
+			nodeAppendKV(root, uint16(i), ptr, knode.getKey(0), countVal(nodeCount(knode)))
+		}
+		split = nodeSplit(root, tree.pageSize)
+	}
+	ptr, err := tree.new(split[0][:tree.pageSize])
+	if err != nil {
+		return err
+	}
+	tree.root = ptr
 	return nil
 }
 
+// Update writes req.Val under req.Key if req.Mode allows it, and reports
+// what it found and did in req.
+func (tree *BTree) Update(req *UpdateReq) error {
+	req.Applied, req.Added, req.Old = false, false, nil
+	if req.Mode < MODE_UPSERT || req.Mode > MODE_CAS {
+		return fmt.Errorf("bad update mode %d", req.Mode)
+	}
+	return tree.freeAfter(func() error {
+		return tree.put(req.Key, req.Val, 0, req)
+	})
+}
+
+// allows reports whether the write applies, given whether the key exists
+// and, if so, its value in req.Old. It records the answer in req.Added.
+func (req *UpdateReq) allows(exists bool) bool {
+	switch {
+	case req.Mode == MODE_UPDATE_ONLY && !exists:
+		return false
+	case req.Mode == MODE_INSERT_ONLY && exists:
+		return false
+	case req.Mode == MODE_CAS && (!exists || !bytes.Equal(req.Old, req.Expect)):
+		return false
+	}
+	req.Added = !exists
+	return true
+}
+
+// Delete deletes key and reports whether it was there. A key that has
+// expired counts as absent and is left for the reaper.
 func (tree *BTree) Delete(key []byte) (bool, error) {
-	if tree.root == 0 {
+	return tree.delete(key, time.Now().UnixNano())
+}
+
+// delete deletes key unless it expired at or before now; a zero now
+// deletes it regardless.
+func (tree *BTree) delete(key []byte, now int64) (bool, error) {
+	var deleted bool
+	err := tree.freeAfter(func() (err error) {
+		deleted, err = tree.deleteKey(key, now)
+		return err
+	})
+	return deleted, err
+}
+
+func (tree *BTree) deleteKey(key []byte, now int64) (bool, error) {
+	if tree.root == 0 || len(key) == 0 {
 		return false, nil
 	}
-	updated := treeDelete(tree, BNode(tree.get(tree.root)), key)
+	rootNode, err := tree.node(tree.root)
+	if err != nil {
+		return false, err
+	}
+	updated, err := treeDelete(tree, rootNode, key, now)
+	if err != nil {
+		return false, err
+	}
 	if len(updated) == 0 {
 		return false, nil
 	}
-	tree.del(tree.root)
+	if err := tree.del(tree.root); err != nil {
+		return false, err
+	}
 	if updated.nkeys() == 0 {
 		tree.root = 0
+		tree.changed(EVENT_DEL, key, nil)
 		return true, nil
 	}
-	tree.root = tree.new(updated[:BTREE_PAGE_SIZE])
+	ptr, err := tree.new(updated[:tree.pageSize])
+	if err != nil {
+		return false, err
+	}
+	tree.root = ptr
+	tree.changed(EVENT_DEL, key, nil)
 	return true, nil
 }
@@ -1,33 +1,75 @@
 package btree
 
 import (
-	"encoding/binary"
+	"crypto/cipher"
 	"fmt"
 	"os"
+	"slices"
 	"sync"
+	"time"
 )
 
 type KV struct {
-	Path string
-	file *os.File
-	tree BTree
-	free FreeList
-	page struct {
-		flushed uint64
-		nappend uint64
-		updates map[uint64][]byte
-		umu     sync.RWMutex
-	}
-	cache  map[uint64][]byte
-	cmu    sync.RWMutex
-	failed bool
+	Path        string
+	CachePages  int
+	Mmap        bool
+	WAL         bool
+	PageSize    int
+	Compress    bool
+	Key         []byte
+	ReadOnly    bool
+	LockTimeout time.Duration // how long Open waits for a lock held elsewhere
+	file        *os.File
+	tree        BTree
+	ttl         BTree   // expiry index, see SetWithTTL
+	changes     []Event // made by the write in progress, see Watch
+	free        FreeList
+	page        struct {
+		size     int
+		compress bool
+		aead     cipher.AEAD
+		flushed  uint64
+		nappend  uint64
+		updates  map[uint64][]byte
+		umu      sync.RWMutex
+		freed    []uint64 // extents freed by the write in progress
+	}
+	cache *pageCache
+	mmap  mmapState
+	wal   walState
+	seq   uint64
 }
 
+// Open releases the file again when it fails, lock included.
 func (db *KV) Open() error {
-	f, err := createFileSync(db.Path)
+	err := db.open()
+	if err != nil && db.file != nil {
+		if db.wal.file != nil {
+			_ = db.wal.file.Close()
+			db.wal.file = nil
+		}
+		_ = db.mmapClose()
+		_ = db.file.Close()
+		db.file = nil
+	}
+	return err
+}
+
+func (db *KV) open() error {
+	var f *os.File
+	var err error
+	if db.ReadOnly {
+		f, err = os.Open(db.Path)
+	} else {
+		f, err = createFileSync(db.Path)
+	}
 	if err != nil {
 		return err
 	}
+	if err := lockFile(f, !db.ReadOnly, db.LockTimeout); err != nil {
+		_ = f.Close()
+		return err
+	}
 	db.file = f
 	fi, err := db.file.Stat()
 	if err != nil {
@@ -36,17 +78,55 @@ func (db *KV) Open() error {
 	db.page.umu.Lock()
 	db.page.updates = make(map[uint64][]byte)
 	db.page.umu.Unlock()
-	db.cmu.Lock()
-	db.cache = make(map[uint64][]byte)
-	db.cmu.Unlock()
-	if err := readRoot(db, fi.Size()); err != nil {
+	if db.PageSize != 0 && !validPageSize(db.PageSize) {
+		return fmt.Errorf("unsupported page size %d", db.PageSize)
+	}
+	db.cache = newPageCache(db.CachePages)
+	db.page.aead = nil
+	if db.Key != nil {
+		if db.page.aead, err = newAEAD(db.Key); err != nil {
+			return err
+		}
+	}
+	slot, err := readRoot(db, fi.Size())
+	if err != nil {
 		return err
 	}
+	if !db.ReadOnly {
+		if err := db.ensureInit(); err != nil {
+			return err
+		}
+	}
+	db.tree.pageSize = db.page.size
+	db.ttl.pageSize = db.page.size
+	db.ttl.keyRoom = EXPIRY_SIZE
+	db.free.pageSize = db.page.size
+	db.free.extents = db.page.compress
+	db.group().reset(saveMeta(db), slot, 0)
+	if db.Mmap {
+		if err := db.mmapInit(fi.Size()); err != nil {
+			return err
+		}
+		db.tree.mapped = db.mmapReads()
+	}
+	if db.WAL {
+		if err := db.walOpen(); err != nil {
+			return err
+		}
+		db.group().reset(saveMeta(db), db.group().slot, db.wal.size)
+	}
 	db.tree.get = db.pageRead
 	db.tree.new = db.pageAlloc
 	db.tree.del = db.free.PushTail
+	if db.page.compress {
+		db.tree.del = db.extentFree
+	}
+	db.tree.pin = db.cache.pin
+	db.tree.unpin = db.cache.unpin
+	db.ttl.get, db.ttl.new, db.ttl.del = db.tree.get, db.tree.new, db.tree.del
+	db.ttl.pin, db.ttl.unpin = db.tree.pin, db.tree.unpin
 	db.free.get = db.pageRead
-	db.free.new = db.pageAppend
+	db.free.new = db.listAppend
 	db.free.set = db.pageWrite
 	db.free.maxSeq = db.free.tailSeq
 	db.RegisterFreeSeqProvider(func(_ *KV) uint64 { return db.free.tailSeq })
@@ -57,104 +137,276 @@ func (db *KV) Close() error {
 	if db.file == nil {
 		return nil
 	}
+	db.watchClose()
+	if db.WAL {
+		if err := db.walClose(); err != nil {
+			return err
+		}
+	}
+	if db.Mmap {
+		if err := db.mmapClose(); err != nil {
+			return err
+		}
+	}
 	err := db.file.Close()
 	db.file = nil
 	return err
 }
 
-func (db *KV) Get(key []byte) ([]byte, bool) {
-	return db.tree.Get(key)
+// Get and Scan read the last durable commit; a transaction in progress
+// sees its own writes through Tx.Get and Tx.Scan.
+func (db *KV) Get(key []byte) ([]byte, bool, error) {
+	r := db.BeginReadTx()
+	defer r.End()
+	return r.Get(key)
+}
+
+// Rank returns the number of keys less than key.
+func (db *KV) Rank(key []byte) (int, error) {
+	r := db.BeginReadTx()
+	defer r.End()
+	return r.Rank(key)
+}
+
+// CountRange returns the number of keys in [start, end); a nil bound is
+// open.
+func (db *KV) CountRange(start, end []byte) (int, error) {
+	r := db.BeginReadTx()
+	defer r.End()
+	return r.CountRange(start, end)
 }
 
 func (db *KV) Set(key []byte, val []byte) error {
+	if db.ReadOnly {
+		return ErrReadOnly
+	}
+	cc := getCC(db)
+	cc.wmu.Lock()
+	db.writeBegin()
 	meta := saveMeta(db)
 	if err := db.tree.Insert(key, val); err != nil {
+		revertMeta(db, meta)
+		cc.wmu.Unlock()
 		return err
 	}
-	return updateOrRevert(db, meta)
+	return commitWrite(db, meta, cc.wmu.Unlock)
+}
+
+// DeleteRange deletes the keys in [start, end) with one commit and returns
+// how many there were.
+func (db *KV) DeleteRange(start []byte, end []byte) (int, error) {
+	if db.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	cc := getCC(db)
+	cc.wmu.Lock()
+	db.writeBegin()
+	meta := saveMeta(db)
+	live, n, err := db.deleteRange(start, end)
+	if err != nil || n == 0 {
+		revertMeta(db, meta)
+		cc.wmu.Unlock()
+		return 0, err
+	}
+	return live, commitWrite(db, meta, cc.wmu.Unlock)
+}
+
+// Update is a conditional Set; it commits only when the write applies.
+func (db *KV) Update(req *UpdateReq) error {
+	if db.ReadOnly {
+		return ErrReadOnly
+	}
+	cc := getCC(db)
+	cc.wmu.Lock()
+	db.writeBegin()
+	meta := saveMeta(db)
+	if err := db.tree.Update(req); err != nil {
+		revertMeta(db, meta)
+		cc.wmu.Unlock()
+		return err
+	}
+	if !req.Applied {
+		cc.wmu.Unlock()
+		return nil
+	}
+	return commitWrite(db, meta, cc.wmu.Unlock)
+}
+
+// BulkLoad loads a sorted stream with BTree.BulkLoad and commits it once.
+func (db *KV) BulkLoad(src BulkSource) error {
+	if db.ReadOnly {
+		return ErrReadOnly
+	}
+	cc := getCC(db)
+	cc.wmu.Lock()
+	db.writeBegin()
+	meta := saveMeta(db)
+	if err := db.tree.BulkLoad(src); err != nil {
+		revertMeta(db, meta)
+		cc.wmu.Unlock()
+		return err
+	}
+	return commitWrite(db, meta, cc.wmu.Unlock)
 }
 
 func (db *KV) Del(key []byte) (bool, error) {
+	if db.ReadOnly {
+		return false, ErrReadOnly
+	}
+	cc := getCC(db)
+	cc.wmu.Lock()
+	db.writeBegin()
 	meta := saveMeta(db)
 	deleted, err := db.tree.Delete(key)
 	if err != nil {
+		revertMeta(db, meta)
+		cc.wmu.Unlock()
 		return false, err
 	}
 	if !deleted {
+		cc.wmu.Unlock()
 		return false, nil
 	}
-	return true, updateOrRevert(db, meta)
+	return true, commitWrite(db, meta, cc.wmu.Unlock)
 }
 
-func (db *KV) pageRead(ptr uint64) []byte {
+func (db *KV) pageRead(ptr uint64) ([]byte, error) {
 	db.page.umu.RLock()
 	if node, ok := db.page.updates[ptr]; ok {
 		db.page.umu.RUnlock()
-		return node
+		return node, nil
 	}
 	db.page.umu.RUnlock()
-	db.cmu.RLock()
-	if p, ok := db.cache[ptr]; ok {
-		db.cmu.RUnlock()
-		return p
+	return db.pageReadCommitted(ptr)
+}
+
+func (db *KV) pageReadCommitted(ptr uint64) ([]byte, error) {
+	if node, ok := db.walPage(ptr); ok {
+		return node, nil
+	}
+	if !db.mmapReads() {
+		if p, ok := db.cache.get(ptr); ok {
+			return p, nil
+		}
 	}
-	db.cmu.RUnlock()
 	return db.pageReadFile(ptr)
 }
 
-func (db *KV) pageReadFile(ptr uint64) []byte {
-	buf := make([]byte, BTREE_PAGE_SIZE)
-	off := int64(ptr) * int64(BTREE_PAGE_SIZE)
-	n, err := db.file.ReadAt(buf, off)
-	if err != nil || n != BTREE_PAGE_SIZE {
-		panic("bad read")
-	}
-	db.cmu.Lock()
-	db.cache[ptr] = buf
-	db.cmu.Unlock()
-	return buf
+// mmapReads reports whether pages are served straight from the mapping;
+// compressed or sealed pages are decoded into the cache instead.
+func (db *KV) mmapReads() bool {
+	return db.Mmap && !db.page.compress && db.page.aead == nil
+}
+
+func (db *KV) pageReadFile(ptr uint64) ([]byte, error) {
+	if db.mmapReads() {
+		if p := db.mmapPage(ptr); p != nil {
+			if err := pageVerify(ptr, p); err != nil {
+				return nil, err
+			}
+			return p, nil
+		}
+	}
+	off, size := db.fileRange(ptr)
+	buf := make([]byte, size)
+	if _, err := db.file.ReadAt(buf, off); err != nil {
+		return nil, &PageError{Page: ptr, Err: err}
+	}
+	buf, err := db.unpackPage(ptr, buf)
+	if err != nil {
+		return nil, err
+	}
+	if err := pageVerify(ptr, buf); err != nil {
+		return nil, err
+	}
+	if !db.mmapReads() {
+		db.cache.put(ptr, buf)
+	}
+	return buf, nil
+}
+
+func (db *KV) pageCopy(node []byte) []byte {
+	copyBuf := make([]byte, db.page.size)
+	copy(copyBuf, node[:db.page.size])
+	return copyBuf
+}
+
+func (db *KV) pageAppend(node []byte) (uint64, error) {
+	copyBuf := db.pageCopy(node)
+	n := 1
+	if db.page.compress {
+		n = db.packedLen(copyBuf)
+	}
+	return db.pageAppendN(copyBuf, n), nil
 }
 
-func (db *KV) pageAppend(node []byte) uint64 {
-	copyBuf := make([]byte, BTREE_PAGE_SIZE)
-	copy(copyBuf, node[:BTREE_PAGE_SIZE])
+// listAppend allocates a free list node. Those are rewritten in place, so
+// they always take a full page.
+func (db *KV) listAppend(node []byte) (uint64, error) {
+	n := 1
+	if db.page.compress {
+		n = db.rawSectors()
+	}
+	return db.pageAppendN(db.pageCopy(node), n), nil
+}
+
+func (db *KV) pageAppendN(copyBuf []byte, n int) uint64 {
 	db.page.umu.Lock()
+	defer db.page.umu.Unlock()
 	ptr := db.page.flushed + db.page.nappend
+	if db.page.compress {
+		ptr = extentPtr(ptr, n)
+	}
 	db.page.updates[ptr] = copyBuf
-	db.page.nappend++
-	db.page.umu.Unlock()
+	db.page.nappend += uint64(n)
 	return ptr
 }
 
-func (db *KV) pageAlloc(node []byte) uint64 {
+func (db *KV) pageAlloc(node []byte) (uint64, error) {
 	allowed := db.OldestActiveReaderSeq()
 	if db.free.maxSeq < allowed {
 		allowed = db.free.maxSeq
 	}
-	if ptr := db.free.PopHeadLe(allowed); ptr != 0 {
-		copyBuf := make([]byte, BTREE_PAGE_SIZE)
-		copy(copyBuf, node[:BTREE_PAGE_SIZE])
+	ptr, err := db.free.PopHeadLe(allowed)
+	if err != nil {
+		return 0, err
+	}
+	copyBuf := db.pageCopy(node)
+	n := 1
+	if db.page.compress {
+		n = db.packedLen(copyBuf)
+		if ptr != 0 {
+			if ptr, err = db.extentTake(ptr, n); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if ptr != 0 {
 		db.page.umu.Lock()
 		db.page.updates[ptr] = copyBuf
 		db.page.umu.Unlock()
-		return ptr
+		return ptr, nil
 	}
-	return db.pageAppend(node)
+	return db.pageAppendN(copyBuf, n), nil
 }
 
-func (db *KV) pageWrite(ptr uint64) []byte {
+func (db *KV) pageWrite(ptr uint64) ([]byte, error) {
 	db.page.umu.RLock()
 	if node, ok := db.page.updates[ptr]; ok {
 		db.page.umu.RUnlock()
-		return node
+		return node, nil
 	}
 	db.page.umu.RUnlock()
-	node := make([]byte, BTREE_PAGE_SIZE)
-	copy(node, db.pageReadFile(ptr))
+	old, err := db.pageReadCommitted(ptr)
+	if err != nil {
+		return nil, err
+	}
+	node := make([]byte, db.page.size)
+	copy(node, old)
 	db.page.umu.Lock()
 	db.page.updates[ptr] = node
 	db.page.umu.Unlock()
-	return node
+	return node, nil
 }
 
 func writePages(db *KV) error {
@@ -167,34 +419,19 @@ func writePages(db *KV) error {
 	}
 	db.page.umu.RUnlock()
 
-	for i := uint64(0); i < nappend; i++ {
-		ptr := flushed + i
-		pg := upd[ptr]
-		off := int64(ptr) * int64(BTREE_PAGE_SIZE)
-		n, err := db.file.WriteAt(pg, off)
-		if err != nil {
+	ptrs := make([]uint64, 0, len(upd))
+	for ptr := range upd {
+		ptrs = append(ptrs, ptr)
+	}
+	slices.Sort(ptrs)
+	for _, ptr := range ptrs {
+		if err := db.writePage(ptr, upd[ptr]); err != nil {
 			return err
 		}
-		if n != BTREE_PAGE_SIZE {
-			return fmt.Errorf("short write")
-		}
-		db.cmu.Lock()
-		db.cache[ptr] = append([]byte(nil), pg...)
-		db.cmu.Unlock()
-	}
-	for ptr, pg := range upd {
-		if ptr < flushed {
-			off := int64(ptr) * int64(BTREE_PAGE_SIZE)
-			n, err := db.file.WriteAt(pg, off)
-			if err != nil {
-				return err
-			}
-			if n != BTREE_PAGE_SIZE {
-				return fmt.Errorf("short write")
-			}
-			db.cmu.Lock()
-			db.cache[ptr] = append([]byte(nil), pg...)
-			db.cmu.Unlock()
+	}
+	if db.Mmap {
+		if err := db.mmapGrow(int64(flushed+nappend) * int64(db.unitSize())); err != nil {
+			return err
 		}
 	}
 
@@ -206,99 +443,34 @@ func writePages(db *KV) error {
 	return nil
 }
 
-const DB_SIG = "BuildYourOwnDB07"
-
-func saveMeta(db *KV) []byte {
-	var data [64]byte
-	copy(data[:16], []byte(DB_SIG))
-	binary.LittleEndian.PutUint64(data[16:], db.tree.root)
-	binary.LittleEndian.PutUint64(data[24:], db.page.flushed)
-	binary.LittleEndian.PutUint64(data[32:], db.free.headPage)
-	binary.LittleEndian.PutUint64(data[40:], db.free.headSeq)
-	binary.LittleEndian.PutUint64(data[48:], db.free.tailPage)
-	binary.LittleEndian.PutUint64(data[56:], db.free.tailSeq)
-	return data[:]
-}
-
-func loadMeta(db *KV, data []byte) {
-	if string(data[:16]) != DB_SIG {
-		return
-	}
-	db.tree.root = binary.LittleEndian.Uint64(data[16:])
-	db.page.flushed = binary.LittleEndian.Uint64(data[24:])
-	db.free.headPage = binary.LittleEndian.Uint64(data[32:])
-	db.free.headSeq = binary.LittleEndian.Uint64(data[40:])
-	db.free.tailPage = binary.LittleEndian.Uint64(data[48:])
-	db.free.tailSeq = binary.LittleEndian.Uint64(data[56:])
-}
-
-func readRoot(db *KV, fileSize int64) error {
-	if fileSize == 0 {
-		db.page.umu.Lock()
-		db.page.flushed = 2
-		db.page.umu.Unlock()
-		db.free.headPage = 1
-		db.free.tailPage = 1
-		return nil
-	}
-	buf := make([]byte, 64)
-	n, err := db.file.ReadAt(buf, 0)
-	if err != nil || n != 64 {
-		return fmt.Errorf("read meta")
-	}
-	loadMeta(db, buf)
-	return nil
-}
-
-func updateRoot(db *KV) error {
-	data := saveMeta(db)
-	n, err := db.file.WriteAt(data, 0)
+func (db *KV) writePage(ptr uint64, pg []byte) error {
+	pageSetChecksum(pg)
+	data, err := db.packPage(ptr, pg)
 	if err != nil {
 		return err
 	}
-	if n != len(data) {
-		return fmt.Errorf("short meta write")
-	}
-	return nil
-}
-
-func updateFile(db *KV) error {
-	if err := writePages(db); err != nil {
+	off, _ := db.fileRange(ptr)
+	n, err := db.file.WriteAt(data, off)
+	if err != nil {
 		return err
 	}
-	if err := db.file.Sync(); err != nil {
-		return err
+	if n != len(data) {
+		return fmt.Errorf("short write")
 	}
-	if err := updateRoot(db); err != nil {
-		return err
+	if !db.mmapReads() {
+		db.cache.put(ptr, append([]byte(nil), pg...))
 	}
-	if err := db.file.Sync(); err != nil {
-		return err
-	}
-	db.free.SetMaxSeq()
 	return nil
 }
 
-func updateOrRevert(db *KV, meta []byte) error {
-	if db.failed {
-		if _, err := db.file.WriteAt(meta, 0); err != nil {
-			return err
-		}
-		if err := db.file.Sync(); err != nil {
-			return err
-		}
-		db.failed = false
-	}
-	err := updateFile(db)
-	if err != nil {
-		loadMeta(db, meta)
-		db.page.umu.Lock()
-		db.page.updates = make(map[uint64][]byte)
-		db.page.nappend = 0
-		db.page.umu.Unlock()
-		db.failed = true
-	}
-	return err
+func revertMeta(db *KV, meta []byte) {
+	loadMeta(db, meta)
+	db.changes = nil
+	db.page.umu.Lock()
+	db.page.updates = make(map[uint64][]byte)
+	db.page.nappend = 0
+	db.page.umu.Unlock()
+	db.page.freed = nil
 }
 
 func createFileSync(file string) (*os.File, error) {
@@ -310,3 +482,5 @@ func createFileSync(file string) (*os.File, error) {
 }
 
 func (db *KV) FreeTailSeq() uint64 { return db.free.tailSeq }
+
+func (db *KV) CacheStats() CacheStats { return db.cache.snapshot() }
@@ -2,11 +2,14 @@ package btree
 
 import "errors"
 
-func checkLimit(key []byte, val []byte) error {
-	if len(key) > BTREE_MAX_KEY_SIZE {
+func (tree *BTree) checkLimit(key []byte, val []byte) error {
+	if len(key) == 0 {
+		return errors.New("empty key")
+	}
+	if len(key) > maxKeySize(tree.pageSize)+tree.keyRoom {
 		return errors.New("key too large")
 	}
-	if len(val) > BTREE_MAX_VAL_SIZE {
+	if len(val) > MAX_VALUE_SIZE {
 		return errors.New("value too large")
 	}
 	return nil
@@ -0,0 +1,34 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ErrLocked is returned by Open when another process, or another KV in
+// this one, holds a conflicting lock on the file.
+var ErrLocked = errors.New("database is locked")
+
+const lockPollInterval = 10 * time.Millisecond
+
+// lockFile takes an advisory lock on the data file, exclusive for a
+// writer, retrying until the timeout runs out. The lock goes away with the
+// file descriptor, so closing the file releases it.
+func lockFile(f *os.File, exclusive bool, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		ok, err := flockTry(f, exclusive)
+		if err != nil {
+			return fmt.Errorf("lock %s: %w", f.Name(), err)
+		}
+		if ok {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("%s: %w", f.Name(), ErrLocked)
+		}
+		time.Sleep(min(lockPollInterval, time.Until(deadline)))
+	}
+}
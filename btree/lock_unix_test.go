@@ -0,0 +1,69 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package btree
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSecondWriterIsLockedOut(t *testing.T) {
+	a := KV{}
+	openKV(t, &a)
+	b := KV{Path: a.Path}
+	if err := b.Open(); !errors.Is(err, ErrLocked) {
+		t.Fatalf("second writer: %v", err)
+	}
+	start := time.Now()
+	b.LockTimeout = 100 * time.Millisecond
+	if err := b.Open(); !errors.Is(err, ErrLocked) {
+		t.Fatalf("second writer with a timeout: %v", err)
+	}
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Fatalf("gave up after %v", d)
+	}
+	// the lock is taken as soon as the first writer lets go
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		a.Close()
+	}()
+	b.LockTimeout = 5 * time.Second
+	if err := b.Open(); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+}
+
+func TestReadersShareTheLock(t *testing.T) {
+	w := KV{}
+	openKV(t, &w)
+	if err := w.Set([]byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	r1 := KV{Path: w.Path, ReadOnly: true}
+	r2 := KV{Path: w.Path, ReadOnly: true}
+	openKV(t, &r1)
+	defer r1.Close()
+	openKV(t, &r2)
+	defer r2.Close()
+	if err := w.Open(); !errors.Is(err, ErrLocked) {
+		t.Fatalf("writer beside readers: %v", err)
+	}
+}
+
+func TestFailedOpenReleasesTheLock(t *testing.T) {
+	kv := KV{}
+	openKV(t, &kv)
+	if err := kv.Set([]byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	kv.Close()
+	bad := KV{Path: kv.Path, Key: testKeyA}
+	if err := bad.Open(); !errors.Is(err, ErrBadKey) {
+		t.Fatalf("opened with a key: %v", err)
+	}
+	openKV(t, &kv)
+	kv.Close()
+}
@@ -1,9 +1,15 @@
 package btree
 
-const HEADER = 4
-
-func leafDelete(new BNode, old BNode, idx uint16) {
+func leafDelete(new BNode, old BNode, idx uint16, pageSize int) {
 	new.setHeader(BNODE_LEAF_TYPE, old.nkeys()-1)
+	switch {
+	case idx == 0:
+		new.setPrefix(rangePrefix(old, 1, old.nkeys()-1, pageSize))
+	case idx == old.nkeys()-1:
+		new.setPrefix(rangePrefix(old, 0, old.nkeys()-1, pageSize))
+	default:
+		new.setPrefix(nodePrefix(old.getKey(0), old.getKey(old.nkeys()-1), old.nkeys()-1, pageSize))
+	}
 	if idx > 0 {
 		nodeAppendRange(new, old, 0, 0, idx)
 	}
@@ -12,40 +18,54 @@ func leafDelete(new BNode, old BNode, idx uint16) {
 	}
 }
 
-func nodeMerge(new BNode, left BNode, right BNode) {
+func nodeMerge(new BNode, left BNode, right BNode, pageSize int) {
 	new.setHeader(left.btype(), left.nkeys()+right.nkeys())
+	new.setPrefix(mergePrefix(left, right, pageSize))
 	nodeAppendRange(new, left, 0, 0, left.nkeys())
 	nodeAppendRange(new, right, left.nkeys(), 0, right.nkeys())
 }
 
-func nodeReplace2Kid(new BNode, old BNode, idx uint16, ptr uint64, key []byte) {
+func nodeReplace2Kid(new BNode, old BNode, idx uint16, ptr uint64, key []byte, count uint64, pageSize int) {
+	first, last := key, key
+	if idx > 0 {
+		first = old.getKey(0)
+	}
+	if idx+2 < old.nkeys() {
+		last = old.getKey(old.nkeys() - 1)
+	}
 	new.setHeader(BNODE_NODE_TYPE, old.nkeys()-1)
+	new.setPrefix(nodePrefix(first, last, old.nkeys()-1, pageSize))
 	if idx > 0 {
 		nodeAppendRange(new, old, 0, 0, idx)
 	}
-	nodeAppendKV(new, idx, ptr, key, nil)
+	nodeAppendKV(new, idx, ptr, key, countVal(count))
 	if idx+2 <= old.nkeys() {
 		nodeAppendRange(new, old, idx+1, idx+2, old.nkeys()-(idx+2))
 	}
 }
 
-func shouldMerge(tree *BTree, node BNode, idx uint16, updated BNode) (int, BNode) {
-	if updated.nbytes() > BTREE_PAGE_SIZE/4 {
-		return 0, BNode{}
+func shouldMerge(tree *BTree, node BNode, idx uint16, updated BNode) (int, BNode, error) {
+	capacity := nodeCap(tree.pageSize)
+	if int(updated.nbytes()) > capacity/4 {
+		return 0, BNode{}, nil
 	}
 	if idx > 0 {
-		sib := BNode(tree.get(node.getPtr(idx - 1)))
-		merged := sib.nbytes() + updated.nbytes() - HEADER
-		if merged <= BTREE_PAGE_SIZE {
-			return -1, sib
+		sib, err := tree.node(node.getPtr(idx - 1))
+		if err != nil {
+			return 0, BNode{}, err
+		}
+		if mergeBytes(sib, updated, tree.pageSize) <= capacity {
+			return -1, sib, nil
 		}
 	}
 	if idx+1 < node.nkeys() {
-		sib := BNode(tree.get(node.getPtr(idx + 1)))
-		merged := sib.nbytes() + updated.nbytes() - HEADER
-		if merged <= BTREE_PAGE_SIZE {
-			return +1, sib
+		sib, err := tree.node(node.getPtr(idx + 1))
+		if err != nil {
+			return 0, BNode{}, err
+		}
+		if mergeBytes(updated, sib, tree.pageSize) <= capacity {
+			return +1, sib, nil
 		}
 	}
-	return 0, BNode{}
+	return 0, BNode{}, nil
 }
@@ -0,0 +1,180 @@
+package btree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// DB_SIG starts every meta block. Its last two digits are the version of
+// the file format, bumped whenever a file written by the previous version
+// can no longer be read.
+const DB_SIG = "BuildYourOwnDB08"
+
+var ErrUnsupportedFormat = errors.New("unsupported database format")
+
+// The meta block lives in two slots in page 0. Each commit bumps the
+// sequence number and overwrites the other slot, so a torn meta write
+// always leaves the previous root reachable.
+const (
+	META_SIZE        = 128
+	META_SLOT_STRIDE = 2048
+)
+
+const META_FLAG_COMPRESS = 1
+
+func saveMeta(db *KV) []byte {
+	data := make([]byte, META_SIZE)
+	copy(data[:16], []byte(DB_SIG))
+	binary.LittleEndian.PutUint64(data[16:], db.tree.root)
+	binary.LittleEndian.PutUint64(data[24:], db.page.flushed)
+	binary.LittleEndian.PutUint64(data[32:], db.free.headPage)
+	binary.LittleEndian.PutUint64(data[40:], db.free.headSeq)
+	binary.LittleEndian.PutUint64(data[48:], db.free.tailPage)
+	binary.LittleEndian.PutUint64(data[56:], db.free.tailSeq)
+	binary.LittleEndian.PutUint64(data[64:], db.seq)
+	binary.LittleEndian.PutUint32(data[72:], uint32(db.page.size))
+	if db.page.compress {
+		binary.LittleEndian.PutUint32(data[76:], META_FLAG_COMPRESS)
+	}
+	binary.LittleEndian.PutUint64(data[80:], db.ttl.root)
+	binary.LittleEndian.PutUint32(data[META_SIZE-4:], metaChecksum(data))
+	return data
+}
+
+func loadMeta(db *KV, data []byte) {
+	db.tree.root = binary.LittleEndian.Uint64(data[16:])
+	db.page.flushed = binary.LittleEndian.Uint64(data[24:])
+	db.free.headPage = binary.LittleEndian.Uint64(data[32:])
+	db.free.headSeq = binary.LittleEndian.Uint64(data[40:])
+	db.free.tailPage = binary.LittleEndian.Uint64(data[48:])
+	db.free.tailSeq = binary.LittleEndian.Uint64(data[56:])
+	db.seq = binary.LittleEndian.Uint64(data[64:])
+	db.ttl.root = binary.LittleEndian.Uint64(data[80:])
+}
+
+func metaChecksum(data []byte) uint32 {
+	return crc32.Checksum(data[:META_SIZE-4], crcTable)
+}
+
+func metaValid(data []byte) bool {
+	return string(data[:16]) == DB_SIG &&
+		binary.LittleEndian.Uint32(data[META_SIZE-4:]) == metaChecksum(data)
+}
+
+func metaRoot(data []byte) uint64 {
+	return binary.LittleEndian.Uint64(data[16:])
+}
+
+func metaSeq(data []byte) uint64 {
+	return binary.LittleEndian.Uint64(data[64:])
+}
+
+func metaFlushed(data []byte) uint64 {
+	return binary.LittleEndian.Uint64(data[24:])
+}
+
+func metaFreeTail(data []byte) uint64 {
+	return binary.LittleEndian.Uint64(data[56:])
+}
+
+// metaPageSize reads the page size chosen when the database was created.
+// Files written before it was recorded use the default.
+func metaPageSize(data []byte) int {
+	size := int(binary.LittleEndian.Uint32(data[72:]))
+	if size == 0 {
+		return BTREE_PAGE_SIZE
+	}
+	return size
+}
+
+func readRoot(db *KV, fileSize int64) (uint64, error) {
+	var best []byte
+	var slot uint64
+	blank := true
+	signed := false
+	other := ""
+	for i := uint64(0); i < 2; i++ {
+		buf := make([]byte, META_SIZE+db.sealOverhead())
+		off := int64(i) * META_SLOT_STRIDE
+		if off < fileSize {
+			if _, err := db.file.ReadAt(buf, off); err != nil && err != io.EOF {
+				return 0, fmt.Errorf("read meta: %w", err)
+			}
+		}
+		if isZeroPage(buf) {
+			continue
+		}
+		blank = false
+		signed = signed || string(buf[:16]) == DB_SIG
+		buf, err := db.unseal(buf, metaAD)
+		if err != nil {
+			continue
+		}
+		if sig := string(buf[:16]); sig != DB_SIG && sig[:14] == DB_SIG[:14] {
+			other = sig
+		}
+		if metaValid(buf) && (best == nil || metaSeq(buf) > metaSeq(best)) {
+			best, slot = buf, i
+		}
+	}
+	if best != nil {
+		size := metaPageSize(best)
+		if !validPageSize(size) {
+			return 0, &PageError{Page: 0, Err: ErrCorruptPage}
+		}
+		if db.PageSize != 0 && db.PageSize != size {
+			return 0, fmt.Errorf("page size %d does not match the database (%d)", db.PageSize, size)
+		}
+		db.page.size = size
+		db.page.compress = binary.LittleEndian.Uint32(best[76:])&META_FLAG_COMPRESS != 0
+		loadMeta(db, best)
+		return slot, nil
+	}
+	if other != "" {
+		return 0, fmt.Errorf("%w: %s, this build reads %s", ErrUnsupportedFormat, other, DB_SIG)
+	}
+	// a plain meta block starts with the signature even when it is torn
+	if !blank && (db.page.aead != nil || !signed) {
+		return 0, ErrBadKey
+	}
+	if !blank {
+		return 0, &PageError{Page: 0, Err: ErrCorruptPage}
+	}
+	db.page.size = BTREE_PAGE_SIZE
+	if db.PageSize != 0 {
+		db.page.size = db.PageSize
+	}
+	db.page.compress = db.Compress
+	flushed, head := db.initLayout()
+	db.page.umu.Lock()
+	db.page.flushed = flushed
+	db.page.umu.Unlock()
+	db.free.headPage = head
+	db.free.tailPage = head
+	return 0, nil
+}
+
+// initLayout is where a blank file ends and where its first free list node
+// is: page 0 holds the meta slots and page 1 the node.
+func (db *KV) initLayout() (flushed uint64, head uint64) {
+	if !db.page.compress {
+		return 2, 1
+	}
+	n := db.rawSectors()
+	return COMPRESS_SECTORS + uint64(n), extentPtr(COMPRESS_SECTORS, n)
+}
+
+func writeMetaSlot(db *KV, data []byte, slot uint64) error {
+	data = db.seal(data, metaAD)
+	n, err := db.file.WriteAt(data, int64(slot)*META_SLOT_STRIDE)
+	if err != nil {
+		return err
+	}
+	if n != len(data) {
+		return fmt.Errorf("short meta write")
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package btree
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestMetaChecksum(t *testing.T) {
+	var kv KV
+	openKV(t, &kv)
+	defer kv.Close()
+	if err := kv.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	meta := saveMeta(&kv)
+	if !metaValid(meta) || metaRoot(meta) != kv.tree.root || metaSeq(meta) != kv.seq {
+		t.Fatal("meta does not round trip")
+	}
+	meta[20] ^= 1
+	if metaValid(meta) {
+		t.Fatal("flipped bit accepted")
+	}
+}
+
+func TestTornMetaFallsBackToPreviousCommit(t *testing.T) {
+	var kv KV
+	openKV(t, &kv)
+	if err := kv.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Set([]byte("b"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	seq, slot := kv.seq, kv.group().slot
+	kv.Close()
+	writeAt(t, &kv, int64(slot)*META_SLOT_STRIDE+20, []byte("garbage"))
+	openKV(t, &kv)
+	defer kv.Close()
+	if kv.seq != seq-1 {
+		t.Fatalf("opened at commit %d, want %d", kv.seq, seq-1)
+	}
+	if _, ok, err := kv.Get([]byte("a")); err != nil || !ok {
+		t.Fatal("a lost", err)
+	}
+	if _, ok, err := kv.Get([]byte("b")); err != nil || ok {
+		t.Fatal("b of the torn commit visible", err)
+	}
+	// the next commit overwrites the torn slot
+	if err := kv.Set([]byte("c"), []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	if kv.group().slot != slot {
+		t.Fatal("the commit did not go to the torn slot")
+	}
+}
+
+func TestBothMetaSlotsCorrupt(t *testing.T) {
+	var kv KV
+	openKV(t, &kv)
+	for _, k := range []string{"a", "b"} {
+		if err := kv.Set([]byte(k), []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kv.Close()
+	for slot := int64(0); slot < 2; slot++ {
+		writeAt(t, &kv, slot*META_SLOT_STRIDE+20, []byte("garbage"))
+	}
+	err := kv.Open()
+	if !errors.Is(err, ErrCorruptPage) {
+		t.Fatal(err)
+	}
+}
+
+// A file written with another version of the format, here one without
+// subtree counts, is refused rather than misread.
+func TestOtherFormatIsRejected(t *testing.T) {
+	var kv KV
+	openKV(t, &kv)
+	for _, k := range []string{"a", "b"} {
+		if err := kv.Set([]byte(k), []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kv.Close()
+	data, err := os.ReadFile(kv.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for slot := int64(0); slot < 2; slot++ {
+		meta := data[slot*META_SLOT_STRIDE:][:META_SIZE]
+		copy(meta, "BuildYourOwnDB07")
+		binary.LittleEndian.PutUint32(meta[META_SIZE-4:], metaChecksum(meta))
+		writeAt(t, &kv, slot*META_SLOT_STRIDE, meta)
+	}
+	if err := kv.Open(); !errors.Is(err, ErrUnsupportedFormat) {
+		kv.Close()
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,96 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+const MMAP_INIT_SIZE = 64 << 20
+
+// mmapState maps the data file in chunks that are never remapped, so
+// page slices handed out earlier stay valid while the mapping grows.
+type mmapState struct {
+	mu     sync.RWMutex
+	size   int64
+	total  int64
+	chunks [][]byte
+}
+
+func (db *KV) mmapInit(size int64) error {
+	total := int64(MMAP_INIT_SIZE)
+	for total < size {
+		total *= 2
+	}
+	chunk, err := mmapFile(db.file, 0, int(total))
+	if err != nil {
+		return fmt.Errorf("mmap: %w", err)
+	}
+	db.mmap.mu.Lock()
+	db.mmap.size = size
+	db.mmap.total = total
+	db.mmap.chunks = [][]byte{chunk}
+	db.mmap.mu.Unlock()
+	return nil
+}
+
+func (db *KV) mmapGrow(size int64) error {
+	db.mmap.mu.Lock()
+	defer db.mmap.mu.Unlock()
+	if size <= db.mmap.size {
+		return nil
+	}
+	for db.mmap.total < size {
+		chunk, err := mmapFile(db.file, db.mmap.total, int(db.mmap.total))
+		if err != nil {
+			return fmt.Errorf("mmap: %w", err)
+		}
+		db.mmap.chunks = append(db.mmap.chunks, chunk)
+		db.mmap.total *= 2
+	}
+	db.mmap.size = size
+	return nil
+}
+
+func (db *KV) mmapPage(ptr uint64) []byte {
+	size := int64(db.page.size)
+	off := int64(ptr) * size
+	db.mmap.mu.RLock()
+	defer db.mmap.mu.RUnlock()
+	if off+size > db.mmap.size {
+		return nil
+	}
+	start := int64(0)
+	for _, chunk := range db.mmap.chunks {
+		if off < start+int64(len(chunk)) {
+			return chunk[off-start : off-start+size]
+		}
+		start += int64(len(chunk))
+	}
+	return nil
+}
+
+// own copies a key or value out of the file mapping before it is returned
+// to the caller, who may keep it after the page is reused, the file
+// shrunk or the mapping closed.
+func (tree *BTree) own(b []byte) []byte {
+	if tree.mapped {
+		return bytes.Clone(b)
+	}
+	return b
+}
+
+func (db *KV) mmapClose() error {
+	db.mmap.mu.Lock()
+	defer db.mmap.mu.Unlock()
+	var first error
+	for _, chunk := range db.mmap.chunks {
+		if err := munmap(chunk); err != nil && first == nil {
+			first = err
+		}
+	}
+	db.mmap.chunks = nil
+	db.mmap.size = 0
+	db.mmap.total = 0
+	return first
+}
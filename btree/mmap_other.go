@@ -0,0 +1,16 @@
+//go:build !unix
+
+package btree
+
+import (
+	"errors"
+	"os"
+)
+
+func mmapFile(f *os.File, off int64, length int) ([]byte, error) {
+	return nil, errors.New("mmap not supported on this platform")
+}
+
+func munmap(b []byte) error {
+	return nil
+}
@@ -0,0 +1,152 @@
+//go:build unix
+
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestMmapReadsServePagesFromTheMapping(t *testing.T) {
+	kv := KV{Mmap: true}
+	openKV(t, &kv)
+	model := map[string]string{}
+	for round := 0; round < 3; round++ {
+		tx, err := kv.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			k, v := testKey(i*3+round), fmt.Sprintf("v%d-%d", round, i)
+			if err := tx.Set(k, []byte(v)); err != nil {
+				t.Fatal(err)
+			}
+			model[string(k)] = v
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		checkModel(t, &kv, model)
+	}
+	if !kv.mmapReads() {
+		t.Fatal("reads do not go through the mapping")
+	}
+	if s := kv.CacheStats(); s.Pages != 0 {
+		t.Fatalf("mapped pages were cached: %+v", s)
+	}
+	kv.Close()
+	openKV(t, &kv)
+	defer kv.Close()
+	checkModel(t, &kv, model)
+}
+
+func TestMmapGrowKeepsEarlierPages(t *testing.T) {
+	kv := KV{Mmap: true}
+	openKV(t, &kv)
+	defer kv.Close()
+	for i := 0; i < 100; i++ {
+		if err := kv.Set(testKey(i), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := kv.mmapPage(kv.tree.root)
+	if root == nil {
+		t.Fatal("root is not mapped")
+	}
+	before := bytes.Clone(root)
+	if err := kv.mmapGrow(kv.mmap.total + 1); err != nil {
+		t.Fatal(err)
+	}
+	if len(kv.mmap.chunks) != 2 {
+		t.Fatalf("%d chunks after growing", len(kv.mmap.chunks))
+	}
+	if !bytes.Equal(root, before) || !bytes.Equal(kv.mmapPage(kv.tree.root), before) {
+		t.Fatal("the page changed when the mapping grew")
+	}
+	if v, ok, err := kv.Get(testKey(42)); err != nil || !ok || string(v) != "v" {
+		t.Fatal("get after growing", ok, err)
+	}
+}
+
+func TestMmapReadTxWithManyWriters(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		t.Run(fmt.Sprintf("wal=%v", wal), func(t *testing.T) {
+			manyWriters(t, &KV{Mmap: true, WAL: wal})
+		})
+	}
+}
+
+// Keys and values handed out in mmap mode are copies: they outlive the
+// reuse of their pages, the shrinking of the file under the mapping and
+// the mapping itself.
+func TestMmapValuesOutliveTheirPages(t *testing.T) {
+	kv := KV{Mmap: true}
+	openKV(t, &kv)
+	defer kv.Close()
+	put := func(gen int) {
+		t.Helper()
+		tx, err := kv.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3000; i++ {
+			if err := tx.Set(testKey(i), []byte(fmt.Sprintf("g%d-%0100d", gen, i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(0)
+	val, ok, err := kv.Get(testKey(2999))
+	if err != nil || !ok {
+		t.Fatal(err)
+	}
+	var key, scanned []byte
+	if err := kv.Scan(testKey(2998), nil, func(k, v []byte) bool {
+		key, scanned = k, v
+		return false
+	}); err != nil {
+		t.Fatal(err)
+	}
+	rt := kv.BeginReadTx()
+	it := rt.NewIter()
+	if !it.SeekGE(testKey(2997), nil) {
+		t.Fatal(it.Err())
+	}
+	itKey, itVal := it.Key(), it.Val()
+	it.Close()
+	rt.End()
+	check := func(when string) {
+		t.Helper()
+		if string(val) != fmt.Sprintf("g0-%0100d", 2999) {
+			t.Fatalf("%s: got %q", when, val)
+		}
+		if string(key) != string(testKey(2998)) || string(scanned) != fmt.Sprintf("g0-%0100d", 2998) {
+			t.Fatalf("%s: scanned %q %q", when, key, scanned)
+		}
+		if string(itKey) != string(testKey(2997)) || string(itVal) != fmt.Sprintf("g0-%0100d", 2997) {
+			t.Fatalf("%s: iterated %q %q", when, itKey, itVal)
+		}
+	}
+	for gen := 1; gen <= 3; gen++ {
+		put(gen)
+	}
+	check("after reuse")
+
+	if _, err := kv.DeleteRange(testKey(100), nil); err != nil {
+		t.Fatal(err)
+	}
+	before := fileSize(t, kv.Path)
+	if err := kv.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if after := fileSize(t, kv.Path); after >= before {
+		t.Fatalf("file of %d bytes not shrunk from %d", after, before)
+	}
+	check("after compaction")
+	kv.Close()
+	check("after closing")
+}
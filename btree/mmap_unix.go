@@ -0,0 +1,16 @@
+//go:build unix
+
+package btree
+
+import (
+	"os"
+	"syscall"
+)
+
+func mmapFile(f *os.File, off int64, length int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), off, length, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmap(b []byte) error {
+	return syscall.Munmap(b)
+}
@@ -1,11 +1,14 @@
 package btree
 
-import "encoding/binary"
+import (
+	"bytes"
+	"encoding/binary"
+)
 
 type BNode []byte
 
 func (node BNode) btype() uint16 {
-	return binary.LittleEndian.Uint16(node[0:2])
+	return binary.LittleEndian.Uint16(node[0:2]) &^ BNODE_PREFIXED
 }
 
 func (node BNode) nkeys() uint16 {
@@ -45,26 +48,88 @@ func (node BNode) setOffset(idx uint16, val uint16) {
 	binary.LittleEndian.PutUint16(node[pos:], val)
 }
 
+// A node flagged BNODE_PREFIXED stores the prefix shared by all its keys
+// once, between the offsets and the KV pairs, and each key without it.
+func (node BNode) prefixed() bool {
+	return binary.LittleEndian.Uint16(node[0:2])&BNODE_PREFIXED != 0
+}
+
+func (node BNode) getPrefix() []byte {
+	if !node.prefixed() {
+		return nil
+	}
+	pos := 4 + 8*node.nkeys() + 2*node.nkeys()
+	plen := binary.LittleEndian.Uint16(node[pos:])
+	return node[pos+2:][:plen]
+}
+
+// setPrefix must follow setHeader and come before any key is appended.
+func (node BNode) setPrefix(prefix []byte) {
+	if len(prefix) == 0 {
+		return
+	}
+	btype := binary.LittleEndian.Uint16(node[0:2])
+	binary.LittleEndian.PutUint16(node[0:2], btype|BNODE_PREFIXED)
+	pos := 4 + 8*node.nkeys() + 2*node.nkeys()
+	binary.LittleEndian.PutUint16(node[pos:], uint16(len(prefix)))
+	copy(node[pos+2:], prefix)
+}
+
+func prefixArea(plen int) uint16 {
+	if plen == 0 {
+		return 0
+	}
+	return 2 + uint16(plen)
+}
+
 func (node BNode) kvPos(idx uint16) uint16 {
 	assert(idx <= node.nkeys())
-	return 4 + 8*node.nkeys() + 2*node.nkeys() + node.getOffset(idx)
+	return 4 + 8*node.nkeys() + 2*node.nkeys() + prefixArea(len(node.getPrefix())) + node.getOffset(idx)
 }
 
-func (node BNode) getKey(idx uint16) []byte {
+// getSuffix returns the stored part of a key, without the node prefix.
+func (node BNode) getSuffix(idx uint16) []byte {
 	assert(idx < node.nkeys())
 	pos := node.kvPos(idx)
 	klen := binary.LittleEndian.Uint16(node[pos:])
 	return node[pos+4:][:klen]
 }
 
+func (node BNode) getKey(idx uint16) []byte {
+	prefix := node.getPrefix()
+	if len(prefix) == 0 {
+		return node.getSuffix(idx)
+	}
+	return append(prefix[:len(prefix):len(prefix)], node.getSuffix(idx)...)
+}
+
+// cmpKey compares the key at idx with key without assembling it.
+func (node BNode) cmpKey(idx uint16, key []byte) int {
+	prefix := node.getPrefix()
+	n := min(len(prefix), len(key))
+	if c := bytes.Compare(prefix[:n], key[:n]); c != 0 {
+		return c
+	}
+	if n < len(prefix) {
+		return 1
+	}
+	return bytes.Compare(node.getSuffix(idx), key[n:])
+}
+
 func (node BNode) getVal(idx uint16) []byte {
 	assert(idx < node.nkeys())
 	pos := node.kvPos(idx)
 	klen := binary.LittleEndian.Uint16(node[pos+0:])
-	vlen := binary.LittleEndian.Uint16(node[pos+2:])
+	vlen := binary.LittleEndian.Uint16(node[pos+2:]) & VAL_LEN_MASK
 	return node[pos+4+klen:][:vlen]
 }
 
+func (node BNode) getFlags(idx uint16) uint16 {
+	assert(idx < node.nkeys())
+	pos := node.kvPos(idx)
+	return binary.LittleEndian.Uint16(node[pos+2:]) &^ VAL_LEN_MASK
+}
+
 func (node BNode) nbytes() uint16 {
 	return node.kvPos(node.nkeys())
 }
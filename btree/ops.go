@@ -1,18 +1,25 @@
 package btree
 
-import "bytes"
-
-func leafInsert(new BNode, old BNode, idx uint16, key []byte, val []byte) {
+func leafInsert(new BNode, old BNode, idx uint16, key []byte, val []byte, flags uint16, pageSize int) {
+	first, last := key, key
+	if idx > 0 {
+		first = old.getKey(0)
+	}
+	if idx < old.nkeys() {
+		last = old.getKey(old.nkeys() - 1)
+	}
 	new.setHeader(BNODE_LEAF_TYPE, old.nkeys()+1)
+	new.setPrefix(nodePrefix(first, last, old.nkeys()+1, pageSize))
 	nodeAppendRange(new, old, 0, 0, idx)
-	nodeAppendKV(new, idx, 0, key, val)
+	nodeAppendCell(new, idx, 0, key, val, flags)
 	nodeAppendRange(new, old, idx+1, idx, old.nkeys()-idx)
 }
 
-func leafUpdate(new BNode, old BNode, idx uint16, key []byte, val []byte) {
+func leafUpdate(new BNode, old BNode, idx uint16, key []byte, val []byte, flags uint16) {
 	new.setHeader(BNODE_LEAF_TYPE, old.nkeys())
+	new.setPrefix(old.getPrefix())
 	nodeAppendRange(new, old, 0, 0, idx)
-	nodeAppendKV(new, idx, 0, key, val)
+	nodeAppendCell(new, idx, 0, key, val, flags)
 	nodeAppendRange(new, old, idx+1, idx+1, old.nkeys()-(idx+1))
 }
 
@@ -20,7 +27,7 @@ func nodeLookupLE(node BNode, key []byte) uint16 {
 	nkeys := node.nkeys()
 	var i uint16
 	for i = 0; i < nkeys; i++ {
-		cmp := bytes.Compare(node.getKey(i), key)
+		cmp := node.cmpKey(i, key)
 		if cmp == 0 {
 			return i
 		}
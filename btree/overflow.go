@@ -0,0 +1,109 @@
+package btree
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// A value too large for a leaf cell is stored in a chain of overflow pages.
+// The cell keeps a reference in its place, the total length and the first
+// page, and is marked with VAL_OVERFLOW in the high bit of its value length.
+// Each overflow page starts with the pointer to the next one.
+const (
+	VAL_OVERFLOW      = 1 << 15
+	VAL_LEN_MASK      = VAL_EXPIRES - 1
+	OVERFLOW_HEADER   = 8
+	OVERFLOW_REF_SIZE = 12
+	MAX_VALUE_SIZE    = 1 << 30
+)
+
+func overflowCap(pageSize int) int {
+	return nodeCap(pageSize) - OVERFLOW_HEADER
+}
+
+// overflowWrite stores val from its last chunk backwards, so every page
+// is allocated knowing its successor, and returns the cell reference.
+func overflowWrite(tree *BTree, val []byte) ([]byte, error) {
+	capacity := overflowCap(tree.pageSize)
+	n := (len(val) + capacity - 1) / capacity
+	next := uint64(0)
+	for i := n - 1; i >= 0; i-- {
+		chunk := val[i*capacity:]
+		if len(chunk) > capacity {
+			chunk = chunk[:capacity]
+		}
+		page := make([]byte, tree.pageSize)
+		binary.LittleEndian.PutUint64(page, next)
+		copy(page[OVERFLOW_HEADER:], chunk)
+		ptr, err := tree.new(page)
+		if err != nil {
+			return nil, err
+		}
+		next = ptr
+	}
+	ref := make([]byte, OVERFLOW_REF_SIZE)
+	binary.LittleEndian.PutUint32(ref[0:], uint32(len(val)))
+	binary.LittleEndian.PutUint64(ref[4:], next)
+	return ref, nil
+}
+
+func overflowRead(tree *BTree, ref []byte) ([]byte, error) {
+	size := int(binary.LittleEndian.Uint32(ref[0:]))
+	ptr := binary.LittleEndian.Uint64(ref[4:])
+	capacity := overflowCap(tree.pageSize)
+	val := make([]byte, 0, size)
+	for len(val) < size {
+		if ptr == 0 {
+			return nil, fmt.Errorf("overflow chain ends at %d of %d bytes", len(val), size)
+		}
+		page, err := tree.get(ptr)
+		if err != nil {
+			return nil, err
+		}
+		chunk := page[OVERFLOW_HEADER:][:capacity]
+		if rest := size - len(val); rest < capacity {
+			chunk = chunk[:rest]
+		}
+		val = append(val, chunk...)
+		ptr = binary.LittleEndian.Uint64(page)
+	}
+	return val, nil
+}
+
+func overflowFree(tree *BTree, ref []byte) error {
+	ptr := binary.LittleEndian.Uint64(ref[4:])
+	for ptr != 0 {
+		page, err := tree.get(ptr)
+		if err != nil {
+			return err
+		}
+		next := binary.LittleEndian.Uint64(page)
+		if err := tree.del(ptr); err != nil {
+			return err
+		}
+		ptr = next
+	}
+	return nil
+}
+
+// leafVal returns the value of a leaf cell, following its overflow chain
+// if it has one.
+func (tree *BTree) leafVal(node BNode, idx uint16) ([]byte, error) {
+	val := node.getVal(idx)
+	if node.getFlags(idx)&VAL_EXPIRES != 0 {
+		val = val[:len(val)-EXPIRY_SIZE]
+	}
+	if node.getFlags(idx)&VAL_OVERFLOW == 0 {
+		return tree.own(val), nil
+	}
+	return overflowRead(tree, val)
+}
+
+// leafFree releases the overflow chain of a leaf cell that is being
+// replaced or deleted.
+func (tree *BTree) leafFree(node BNode, idx uint16) error {
+	if node.getFlags(idx)&VAL_OVERFLOW == 0 {
+		return nil
+	}
+	return overflowFree(tree, node.getVal(idx))
+}
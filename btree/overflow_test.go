@@ -0,0 +1,79 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestOverflowValues(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		t.Run(fmt.Sprintf("wal=%v", wal), func(t *testing.T) {
+			kv := KV{WAL: wal}
+			openKV(t, &kv)
+			defer kv.Close()
+			r := rand.New(rand.NewSource(1))
+			model := map[string]string{}
+			var peak uint64
+			for round := 0; round < 300; round++ {
+				k := fmt.Sprintf("k%02d", r.Intn(20))
+				if r.Intn(4) == 0 {
+					if _, err := kv.Del([]byte(k)); err != nil {
+						t.Fatal(err)
+					}
+					delete(model, k)
+				} else {
+					v := string(bytes.Repeat([]byte{byte('a' + r.Intn(26))}, r.Intn(60000)))
+					v += fmt.Sprint(round)
+					if err := kv.Set([]byte(k), []byte(v)); err != nil {
+						t.Fatal(err)
+					}
+					model[k] = v
+				}
+				if round == 150 {
+					peak = kv.page.flushed
+				}
+			}
+			checkModel(t, &kv, model)
+			// the chains of replaced and deleted values are reused
+			if kv.page.flushed > peak*2 {
+				t.Fatalf("the file grew from %d to %d pages", peak, kv.page.flushed)
+			}
+			kv.Close()
+			openKV(t, &kv)
+			checkModel(t, &kv, model)
+		})
+	}
+}
+
+func TestOverflowIterVal(t *testing.T) {
+	kv := KV{}
+	openKV(t, &kv)
+	defer kv.Close()
+	big := bytes.Repeat([]byte("0123456789"), 2000)
+	for i := 0; i < 3; i++ {
+		if err := kv.Set(testKey(i), append(big, byte('0'+i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	iter := NewIter(&kv.tree)
+	defer iter.Close()
+	n := 0
+	for ok := iter.SeekGE(nil, nil); ok; ok = iter.Next() {
+		key := iter.Key()
+		if len(key) == 0 {
+			continue
+		}
+		if val := iter.Val(); !bytes.Equal(val, append(big, byte('0'+n))) {
+			t.Fatalf("%q: value of %d bytes", key, len(val))
+		}
+		n++
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("iterated over %d keys", n)
+	}
+}
@@ -0,0 +1,71 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestPageSizes(t *testing.T) {
+	for _, size := range PAGE_SIZES {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			kv := KV{PageSize: size}
+			openKV(t, &kv)
+			model := map[string]string{}
+			tx, err := kv.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2000; i++ {
+				k := testKey(i)
+				v := fmt.Sprintf("%d%s", i, bytes.Repeat([]byte("v"), i%300))
+				if err := tx.Set(k, []byte(v)); err != nil {
+					t.Fatal(err)
+				}
+				model[string(k)] = v
+			}
+			// the largest key and value this page size allows
+			big := bytes.Repeat([]byte("K"), maxKeySize(size))
+			val := bytes.Repeat([]byte("V"), maxValSize(size))
+			if err := tx.Set(big, val); err != nil {
+				t.Fatal(err)
+			}
+			model[string(big)] = string(val)
+			if err := tx.Set(append(big, 'x'), nil); err == nil {
+				t.Fatal("a key past the limit was taken")
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			checkTree(t, &kv.tree)
+			kv.Close()
+
+			// the size comes from the file when none is asked for
+			kv.PageSize = 0
+			openKV(t, &kv)
+			if kv.page.size != size {
+				t.Fatalf("reopened with %d byte pages", kv.page.size)
+			}
+			checkModel(t, &kv, model)
+			kv.Close()
+
+			kv.PageSize = PAGE_SIZES[0]
+			if size == PAGE_SIZES[0] {
+				kv.PageSize = PAGE_SIZES[1]
+			}
+			if err := kv.Open(); err == nil {
+				kv.Close()
+				t.Fatal("opened with another page size")
+			}
+		})
+	}
+}
+
+func TestUnsupportedPageSize(t *testing.T) {
+	kv := KV{Path: filepath.Join(t.TempDir(), "test.db"), PageSize: 1000}
+	if err := kv.Open(); err == nil {
+		kv.Close()
+		t.Fatal("opened with a page size of 1000")
+	}
+}
@@ -0,0 +1,56 @@
+package btree
+
+// nodePrefix picks the prefix a node stores once, given the first and last
+// of its keys. The saving is capped at a page per node, so rebuilding a
+// node with a shorter prefix grows it by at most that much.
+func nodePrefix(first []byte, last []byte, nkeys uint16, pageSize int) []byte {
+	n := 0
+	for n < len(first) && n < len(last) && first[n] == last[n] {
+		n++
+	}
+	if nkeys > 0 {
+		n = min(n, pageSize/int(nkeys))
+	}
+	return first[:n]
+}
+
+// rangePrefix is the prefix of a node holding keys [start, start+n) of old.
+func rangePrefix(old BNode, start uint16, n uint16, pageSize int) []byte {
+	if n == 0 {
+		return nil
+	}
+	return nodePrefix(old.getKey(start), old.getKey(start+n-1), n, pageSize)
+}
+
+// rangeBytes is the size of a node holding keys [start, start+n) of old.
+func rangeBytes(old BNode, start uint16, n uint16, pageSize int) int {
+	prefix := rangePrefix(old, start, n, pageSize)
+	size := 4 + 10*int(n) + int(prefixArea(len(prefix)))
+	size += int(old.getOffset(start+n) - old.getOffset(start))
+	return size - int(n)*(len(prefix)-len(old.getPrefix()))
+}
+
+func mergePrefix(left BNode, right BNode, pageSize int) []byte {
+	n := left.nkeys() + right.nkeys()
+	switch {
+	case n == 0:
+		return nil
+	case left.nkeys() == 0:
+		return rangePrefix(right, 0, n, pageSize)
+	case right.nkeys() == 0:
+		return rangePrefix(left, 0, n, pageSize)
+	}
+	return nodePrefix(left.getKey(0), right.getKey(right.nkeys()-1), n, pageSize)
+}
+
+// mergeBytes is the size of the node nodeMerge builds from left and right.
+func mergeBytes(left BNode, right BNode, pageSize int) int {
+	prefix := mergePrefix(left, right, pageSize)
+	size := 4 + int(prefixArea(len(prefix)))
+	for _, node := range []BNode{left, right} {
+		n := int(node.nkeys())
+		size += 10*n + int(node.getOffset(node.nkeys()))
+		size -= n * (len(prefix) - len(node.getPrefix()))
+	}
+	return size
+}
@@ -0,0 +1,119 @@
+package btree
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestNodePrefix(t *testing.T) {
+	cases := []struct {
+		first, last string
+		nkeys       uint16
+		want        string
+	}{
+		{"t|users|001", "t|users|999", 10, "t|users|"},
+		{"abc", "abd", 2, "ab"},
+		{"abc", "xyz", 2, ""},
+		{"", "abc", 2, ""},
+		{"abc", "abc", 1, "abc"},
+		// the saving is capped at a page
+		{strings.Repeat("a", 900), strings.Repeat("a", 900) + "b", 8, strings.Repeat("a", 512)},
+	}
+	for _, c := range cases {
+		got := nodePrefix([]byte(c.first), []byte(c.last), c.nkeys, BTREE_PAGE_SIZE)
+		if string(got) != c.want {
+			t.Errorf("nodePrefix(%q, %q, %d) = %q, want %q", c.first, c.last, c.nkeys, got, c.want)
+		}
+	}
+}
+
+func TestPrefixedKeys(t *testing.T) {
+	for _, size := range PAGE_SIZES {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			kv := KV{PageSize: size}
+			openKV(t, &kv)
+			defer kv.Close()
+			r := rand.New(rand.NewSource(1))
+			model := map[string]string{}
+			groups := []string{
+				strings.Repeat("a", maxKeySize(size)-6),
+				strings.Repeat("a", maxKeySize(size)/2) + "b",
+				"t|users|",
+				"z" + strings.Repeat("q", 300),
+			}
+			for round := 0; round < 3; round++ {
+				tx, err := kv.Begin()
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i := 0; i < 1000; i++ {
+					k := groups[r.Intn(len(groups))] + fmt.Sprintf("%06d", r.Intn(2000))
+					if round >= 2 && r.Intn(2) == 0 {
+						if _, err := tx.Del([]byte(k)); err != nil {
+							t.Fatal(err)
+						}
+						delete(model, k)
+						continue
+					}
+					v := strings.Repeat("v", r.Intn(40))
+					if r.Intn(100) == 0 {
+						v = strings.Repeat("w", r.Intn(maxValSize(size)))
+					}
+					if err := tx.Set([]byte(k), []byte(v)); err != nil {
+						t.Fatal(err)
+					}
+					model[k] = v
+				}
+				if err := tx.Commit(); err != nil {
+					t.Fatal(err)
+				}
+				checkTree(t, &kv.tree)
+				checkModel(t, &kv, model)
+			}
+		})
+	}
+}
+
+// Keys sharing a long prefix take much less room in the leaves than they
+// would stored in full.
+func TestPrefixDensity(t *testing.T) {
+	kv := KV{}
+	openKV(t, &kv)
+	defer kv.Close()
+	tx, err := kv.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 5000
+	for i := 0; i < n; i++ {
+		k := fmt.Sprintf("i|orders|by_customer|%08d|%08d", i/7, i)
+		if err := tx.Set([]byte(k), []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	used := 0
+	var walk func(ptr uint64)
+	walk = func(ptr uint64) {
+		node, err := kv.tree.node(ptr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if node.btype() == BNODE_LEAF_TYPE {
+			used += int(node.nbytes())
+			return
+		}
+		for i := uint16(0); i < node.nkeys(); i++ {
+			walk(node.getPtr(i))
+		}
+	}
+	walk(kv.tree.root)
+	// an unprefixed cell takes 10 bytes of header, 38 of key and 1 of value
+	if full := n * 49; used > full*2/3 {
+		t.Fatalf("leaves use %d bytes, %d stored in full", used, full)
+	}
+}
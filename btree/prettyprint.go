@@ -15,7 +15,10 @@ func (n BNode) Pretty() string {
 		tn = "internal"
 	}
 	fmt.Fprintf(&b, "node type=%s nkeys=%d used=%d\n", tn, n.nkeys(), n.nbytes())
-	base := 4 + 8*n.nkeys() + 2*n.nkeys()
+	if prefix := n.getPrefix(); len(prefix) > 0 {
+		fmt.Fprintf(&b, "prefix=%s\n", showBytes(prefix))
+	}
+	base := n.kvPos(0)
 	fmt.Fprintf(&b, "header=4 ptrs=%d offs=%d base=%d\n", 8*n.nkeys(), 2*n.nkeys(), base)
 	for i := uint16(1); i <= n.nkeys(); i++ {
 		fmt.Fprintf(&b, "off[%d]=%d\n", i, n.getOffset(i))
@@ -27,7 +30,7 @@ func (n BNode) Pretty() string {
 			fmt.Fprintf(&b, "[%d] key=%s val=%s\n", i, k, v)
 		} else {
 			ptr := n.getPtr(i)
-			fmt.Fprintf(&b, "[%d] key=%s ptr=%d\n", i, k, ptr)
+			fmt.Fprintf(&b, "[%d] key=%s ptr=%d count=%d\n", i, k, ptr, n.getCount(i))
 		}
 	}
 	return b.String()
@@ -49,8 +52,11 @@ func (t *BTree) prettyAt(page uint64, depth int, b *strings.Builder, seen map[ui
 		return
 	}
 	seen[page] = true
-	raw := t.get(page)
-	n := BNode(raw)
+	n, err := t.node(page)
+	if err != nil {
+		fmt.Fprintf(b, "%s#%d %v\n", strings.Repeat("  ", depth), page, err)
+		return
+	}
 	tn := "unknown"
 	switch n.btype() {
 	case BNODE_LEAF_TYPE:
@@ -67,7 +73,7 @@ func (t *BTree) prettyAt(page uint64, depth int, b *strings.Builder, seen map[ui
 			fmt.Fprintf(b, "%s  [%d] key=%s val=%s\n", indent, i, k, v)
 		} else {
 			ptr := n.getPtr(i)
-			fmt.Fprintf(b, "%s  [%d] key=%s -> #%d\n", indent, i, k, ptr)
+			fmt.Fprintf(b, "%s  [%d] key=%s -> #%d (%d)\n", indent, i, k, ptr, n.getCount(i))
 		}
 	}
 	if n.btype() == BNODE_NODE_TYPE {
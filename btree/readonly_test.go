@@ -0,0 +1,70 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadOnly(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		t.Run(fmt.Sprintf("wal=%v", wal), func(t *testing.T) {
+			w := KV{WAL: wal}
+			openKV(t, &w)
+			model := fillKV(t, &w, 2000)
+			if err := w.Set([]byte("late"), []byte("x")); err != nil {
+				t.Fatal(err)
+			}
+			model["late"] = "x"
+			// leave the log unapplied
+			crashKV(t, &w)
+			before, _ := os.ReadFile(w.Path)
+			walBefore, _ := os.ReadFile(walPath(w.Path))
+
+			r := KV{Path: w.Path, WAL: wal, ReadOnly: true}
+			openKV(t, &r)
+			checkModel(t, &r, model)
+			if err := r.Set([]byte("a"), []byte("b")); err != ErrReadOnly {
+				t.Fatalf("Set: %v", err)
+			}
+			if _, err := r.Del([]byte("a")); err != ErrReadOnly {
+				t.Fatalf("Del: %v", err)
+			}
+			if _, err := r.Begin(); err != ErrReadOnly {
+				t.Fatalf("Begin: %v", err)
+			}
+			if _, err := r.BeginWrite(); err != ErrReadOnly {
+				t.Fatalf("BeginWrite: %v", err)
+			}
+			if err := r.Compact(); err != ErrReadOnly {
+				t.Fatalf("Compact: %v", err)
+			}
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+			after, _ := os.ReadFile(w.Path)
+			walAfter, _ := os.ReadFile(walPath(w.Path))
+			if !bytes.Equal(before, after) || !bytes.Equal(walBefore, walAfter) {
+				t.Fatal("a read-only open changed the files")
+			}
+
+			w = KV{Path: w.Path, WAL: wal}
+			openKV(t, &w)
+			defer w.Close()
+			checkModel(t, &w, model)
+		})
+	}
+}
+
+func TestReadOnlyMissingFile(t *testing.T) {
+	kv := KV{Path: filepath.Join(t.TempDir(), "none.db"), ReadOnly: true}
+	if err := kv.Open(); err == nil {
+		kv.Close()
+		t.Fatal("opened a file that does not exist")
+	}
+	if _, err := os.Stat(kv.Path); !os.IsNotExist(err) {
+		t.Fatal("the file was created")
+	}
+}
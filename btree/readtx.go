@@ -0,0 +1,65 @@
+package btree
+
+// ReadTx reads the database as of the last durable commit. The root is
+// fixed when the transaction begins and the reader guard it holds keeps
+// every page reachable from that root out of reuse, so writers may commit
+// while it reads. End must be called to let those pages go.
+type ReadTx struct {
+	tree  BTree
+	guard *readGuard
+}
+
+func (db *KV) BeginReadTx() *ReadTx {
+	cc := getCC(db)
+	g := db.group()
+	// register before a commit can advance the durable meta, so no page
+	// freed after the snapshot is handed out before the guard is visible
+	g.mu.Lock()
+	meta := g.durableMeta
+	cc.mu.Lock()
+	cc.nextID++
+	id := cc.nextID
+	seq := metaFreeTail(meta)
+	cc.readers[id] = seq
+	cc.mu.Unlock()
+	g.mu.Unlock()
+	return &ReadTx{
+		tree: BTree{
+			root:     metaRoot(meta),
+			pageSize: db.page.size,
+			get:      db.pageReadCommitted,
+			pin:      db.cache.pin,
+			unpin:    db.cache.unpin,
+			mapped:   db.mmapReads(),
+		},
+		guard: &readGuard{db: db, seq: seq, id: id},
+	}
+}
+
+func (r *ReadTx) Get(key []byte) ([]byte, bool, error) {
+	return r.tree.Get(key)
+}
+
+func (r *ReadTx) Scan(start, end []byte, fn ScanFn) error {
+	return scanTree(&r.tree, start, end, fn)
+}
+
+func (r *ReadTx) ScanReverse(start, end []byte, fn ScanFn) error {
+	return scanTreeReverse(&r.tree, start, end, fn)
+}
+
+func (r *ReadTx) Rank(key []byte) (int, error) {
+	return r.tree.Rank(key)
+}
+
+func (r *ReadTx) CountRange(start, end []byte) (int, error) {
+	return r.tree.CountRange(start, end)
+}
+
+func (r *ReadTx) NewIter() *Iter {
+	return NewIter(&r.tree)
+}
+
+func (r *ReadTx) End() {
+	r.guard.End()
+}
@@ -0,0 +1,202 @@
+package btree
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// A snapshot sees one whole generation of values while a writer keeps
+// rewriting every key, and the pages it reads are not reused under it.
+func TestReadTxSeesOneCommit(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		t.Run(fmt.Sprintf("wal=%v", wal), func(t *testing.T) {
+			kv := KV{WAL: wal, CachePages: 64}
+			openKV(t, &kv)
+			defer kv.Close()
+			const n = 500
+			put := func(gen int) error {
+				tx, err := kv.BeginWrite()
+				if err != nil {
+					return err
+				}
+				for i := 0; i < n; i++ {
+					if err := tx.Set(testKey(i), []byte(fmt.Sprintf("g%06d-%0200d", gen, i))); err != nil {
+						tx.Rollback()
+						return err
+					}
+				}
+				return tx.Commit()
+			}
+			if err := put(0); err != nil {
+				t.Fatal(err)
+			}
+			var wg sync.WaitGroup
+			stop := make(chan struct{})
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for gen := 1; ; gen++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					if err := put(gen); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+			defer func() {
+				close(stop)
+				wg.Wait()
+			}()
+			for r := 0; r < 30; r++ {
+				rt := kv.BeginReadTx()
+				var gen string
+				count := 0
+				err := rt.Scan(nil, nil, func(k, v []byte) bool {
+					if gen == "" {
+						gen = string(v[:7])
+					} else if string(v[:7]) != gen {
+						t.Errorf("generations %s and %s in one snapshot", gen, v[:7])
+						return false
+					}
+					count++
+					return true
+				})
+				if err != nil || count != n {
+					t.Fatalf("scanned %d keys: %v", count, err)
+				}
+				v, ok, err := rt.Get(testKey(250))
+				if err != nil || !ok || string(v[:7]) != gen {
+					t.Fatalf("get: %q %v %v, want %s", v, ok, err, gen)
+				}
+				it := rt.NewIter()
+				if !it.SeekGE(testKey(100), testKey(102)) || string(it.Key()) != string(testKey(100)) {
+					t.Fatal("iterator did not find its start")
+				}
+				if !it.Next() || it.Next() {
+					t.Fatal("iterator went past its end")
+				}
+				it.Close()
+				rt.End()
+			}
+		})
+	}
+}
+
+func TestReadTxIgnoresLaterCommits(t *testing.T) {
+	kv := KV{}
+	openKV(t, &kv)
+	defer kv.Close()
+	if err := kv.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	rt := kv.BeginReadTx()
+	defer rt.End()
+	if err := kv.Set([]byte("a"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Set([]byte("b"), []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, err := rt.Get([]byte("a")); err != nil || string(v) != "1" {
+		t.Fatalf("a = %q %v", v, err)
+	}
+	if _, ok, err := rt.Get([]byte("b")); err != nil || ok {
+		t.Fatalf("b visible: %v", err)
+	}
+}
+
+// manyWriters runs 4 writers, each rewriting every key in one transaction
+// and now and then compacting, under 4 readers that check each snapshot
+// holds one transaction's values. Free pages, the free list's own nodes
+// included, must not be reused under any of the readers.
+func manyWriters(t *testing.T, kv *KV) {
+	t.Helper()
+	openKV(t, kv)
+	defer kv.Close()
+	const n = 200
+	put := func(tag string) error {
+		tx, err := kv.BeginWrite()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			if err := tx.Set(testKey(i), []byte(fmt.Sprintf("%s-%0100d", tag, i))); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		return tx.Commit()
+	}
+	if err := put("w0-0000"); err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	var readers, writers sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				rt := kv.BeginReadTx()
+				var tag string
+				count := 0
+				err := rt.Scan(nil, nil, func(k, v []byte) bool {
+					if tag == "" {
+						tag = string(v[:7])
+					} else if string(v[:7]) != tag {
+						t.Errorf("torn snapshot: %s and %s", tag, v[:7])
+						return false
+					}
+					count++
+					return true
+				})
+				rt.End()
+				if err != nil || count != n {
+					t.Errorf("scanned %d keys: %v", count, err)
+					return
+				}
+			}
+		}()
+	}
+	for w := 0; w < 4; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			for gen := 1; gen <= 25; gen++ {
+				if err := put(fmt.Sprintf("w%d-%04d", w, gen)); err != nil {
+					t.Error(err)
+					return
+				}
+				if w == 0 && gen%10 == 0 {
+					if err := kv.Compact(); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	writers.Wait()
+	close(stop)
+	readers.Wait()
+}
+
+func TestReadTxWithManyWriters(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		for _, compress := range []bool{false, true} {
+			t.Run(fmt.Sprintf("wal=%v,compress=%v", wal, compress), func(t *testing.T) {
+				manyWriters(t, &KV{WAL: wal, Compress: compress})
+			})
+		}
+	}
+}
@@ -2,17 +2,60 @@ package btree
 
 type ScanFn func(k, v []byte) bool
 
-func (db *KV) Scan(start, end []byte, fn ScanFn) {
-	it := NewIter(&db.tree)
+func (db *KV) Scan(start, end []byte, fn ScanFn) error {
+	r := db.BeginReadTx()
+	defer r.End()
+	return r.Scan(start, end, fn)
+}
+
+func scanTree(tree *BTree, start, end []byte, fn ScanFn) error {
+	it := NewIter(tree)
+	defer it.Close()
 	if !it.SeekGE(start, end) {
-		return
+		return it.Err()
 	}
 	for it.Valid() {
-		if !fn(it.Key(), it.Val()) {
-			return
+		key, val := it.Key(), it.Val()
+		if it.err != nil {
+			return it.err
+		}
+		if !fn(key, val) {
+			return nil
 		}
 		if !it.Next() {
-			return
+			return it.Err()
+		}
+	}
+	return nil
+}
+
+// ScanReverse visits the keys in [start, end) from the last to the first.
+func (db *KV) ScanReverse(start, end []byte, fn ScanFn) error {
+	r := db.BeginReadTx()
+	defer r.End()
+	return r.ScanReverse(start, end, fn)
+}
+
+func scanTreeReverse(tree *BTree, start, end []byte, fn ScanFn) error {
+	it := NewIter(tree)
+	defer it.Close()
+	if !it.SeekLE(end, start) {
+		return it.Err()
+	}
+	if end != nil && it.leaf.cmpKey(uint16(it.idx), end) == 0 && !it.Prev() {
+		return it.Err()
+	}
+	for it.Valid() {
+		key, val := it.Key(), it.Val()
+		if it.err != nil {
+			return it.err
+		}
+		if !fn(key, val) {
+			return nil
+		}
+		if !it.Prev() {
+			return it.Err()
 		}
 	}
+	return nil
 }
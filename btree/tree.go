@@ -1,41 +1,135 @@
 package btree
 
-import "bytes"
+import (
+	"bytes"
+	"time"
+)
 
 type BTree struct {
-	root uint64
-	get  func(uint64) []byte
-	new  func([]byte) uint64
-	del  func(uint64)
+	root     uint64
+	pageSize int
+	keyRoom  int // key bytes allowed past the limit of the page size
+	get      func(uint64) ([]byte, error)
+	new      func([]byte) (uint64, error)
+	del      func(uint64) error
+	pin      func(uint64)
+	unpin    func(uint64)
+	watch    func(kind int, key []byte, val []byte) // see KV.Watch
+	// mapped is set when pages may be views of the file mapping; see own
+	mapped bool
 }
 
-func treeInsert(tree *BTree, node BNode, key []byte, val []byte) BNode {
-	newNode := BNode(make([]byte, 2*BTREE_PAGE_SIZE))
+// changed reports a put or a delete to the watch hook, if there is one.
+func (tree *BTree) changed(kind int, key []byte, val []byte) {
+	if tree.watch != nil {
+		tree.watch(kind, key, val)
+	}
+}
+
+// freeAfter runs a change to the tree with the pages it frees held back
+// until it succeeds. Until then the tree still reaches them, and one that
+// fails halfway leaves it intact.
+func (tree *BTree) freeAfter(change func() error) error {
+	del := tree.del
+	var freed []uint64
+	tree.del = func(ptr uint64) error {
+		freed = append(freed, ptr)
+		return nil
+	}
+	err := change()
+	tree.del = del
+	if err != nil {
+		return err
+	}
+	for _, ptr := range freed {
+		if err := del(ptr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tree *BTree) node(ptr uint64) (BNode, error) {
+	page, err := tree.get(ptr)
+	if err != nil {
+		return nil, err
+	}
+	return BNode(page), nil
+}
+
+// treeInsert returns the node that replaces node, or nil if req turns the
+// write down.
+func treeInsert(tree *BTree, node BNode, key []byte, val []byte, expires int64, req *UpdateReq) (BNode, error) {
+	newNode := BNode(make([]byte, 4*tree.pageSize))
 	idx := nodeLookupLE(node, key)
 	switch node.btype() {
 	case BNODE_LEAF_TYPE:
-		if bytes.Equal(key, node.getKey(idx)) {
-			leafUpdate(newNode, node, idx, key, val)
+		found := node.cmpKey(idx, key) == 0
+		if req != nil {
+			exists := found && !node.expired(idx, time.Now().UnixNano())
+			if exists {
+				old, err := tree.leafVal(node, idx)
+				if err != nil {
+					return nil, err
+				}
+				req.Old = bytes.Clone(old)
+			}
+			if !req.allows(exists) {
+				return nil, nil
+			}
+		}
+		cell, flags, err := tree.cellVal(val, expires)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			if err := tree.leafFree(node, idx); err != nil {
+				return nil, err
+			}
+			leafUpdate(newNode, node, idx, key, cell, flags)
 		} else {
-			leafInsert(newNode, node, idx+1, key, val)
+			leafInsert(newNode, node, idx+1, key, cell, flags, tree.pageSize)
 		}
 	case BNODE_NODE_TYPE:
 		kptr := node.getPtr(idx)
-		knode := treeInsert(tree, BNode(tree.get(kptr)), key, val)
-		nsplit, split := nodeSplit3(knode)
-		tree.del(kptr)
-		nodeReplaceKidN(tree, newNode, node, idx, split[:nsplit]...)
+		kid, err := tree.node(kptr)
+		if err != nil {
+			return nil, err
+		}
+		knode, err := treeInsert(tree, kid, key, val, expires, req)
+		if err != nil || knode == nil {
+			return nil, err
+		}
+		split := nodeSplit(knode, tree.pageSize)
+		if err := tree.del(kptr); err != nil {
+			return nil, err
+		}
+		if err := nodeReplaceKidN(tree, newNode, node, idx, split...); err != nil {
+			return nil, err
+		}
 	}
-	return newNode
+	return newNode, nil
 }
 
-func nodeReplaceKidN(tree *BTree, newNode BNode, old BNode, idx uint16, kids ...BNode) {
+func nodeReplaceKidN(tree *BTree, newNode BNode, old BNode, idx uint16, kids ...BNode) error {
 	inc := uint16(len(kids))
+	first, last := kids[0].getKey(0), kids[inc-1].getKey(0)
+	if idx > 0 {
+		first = old.getKey(0)
+	}
+	if idx+1 < old.nkeys() {
+		last = old.getKey(old.nkeys() - 1)
+	}
 	newNode.setHeader(BNODE_NODE_TYPE, old.nkeys()+inc-1)
+	newNode.setPrefix(nodePrefix(first, last, old.nkeys()+inc-1, tree.pageSize))
 	nodeAppendRange(newNode, old, 0, 0, idx)
 	for i, nd := range kids {
-		ptr := tree.new(nd)
-		nodeAppendKV(newNode, idx+uint16(i), ptr, nd.getKey(0), nil)
+		ptr, err := tree.new(nd)
+		if err != nil {
+			return err
+		}
+		nodeAppendKV(newNode, idx+uint16(i), ptr, nd.getKey(0), countVal(nodeCount(nd)))
 	}
 	nodeAppendRange(newNode, old, idx+inc, idx+1, old.nkeys()-(idx+1))
+	return nil
 }
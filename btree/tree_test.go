@@ -0,0 +1,119 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+var errTestIO = errors.New("test i/o error")
+
+func TestPagerErrorsAreReturned(t *testing.T) {
+	var kv KV
+	openKV(t, &kv)
+	defer kv.Close()
+	for i := 0; i < 1000; i++ {
+		if err := kv.Set(testKey(i), bytes.Repeat([]byte("v"), 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// fail the reads of the leaf holding k00500
+	key := testKey(500)
+	get := kv.tree.get
+	kv.tree.get = func(ptr uint64) ([]byte, error) {
+		pg, err := get(ptr)
+		if node := BNode(pg); err == nil && node.btype() == BNODE_LEAF_TYPE &&
+			bytes.Equal(node.getKey(nodeLookupLE(node, key)), key) {
+			return nil, errTestIO
+		}
+		return pg, err
+	}
+	if _, _, err := kv.tree.Get(key); !errors.Is(err, errTestIO) {
+		t.Fatal("get:", err)
+	}
+	it := NewIter(&kv.tree)
+	for ok := it.SeekGE(testKey(400), nil); ok; ok = it.Next() {
+	}
+	it.Close()
+	if !errors.Is(it.Err(), errTestIO) {
+		t.Fatal("iter:", it.Err())
+	}
+	if err := kv.tree.Insert(key, []byte("x")); !errors.Is(err, errTestIO) {
+		t.Fatal("insert:", err)
+	}
+	if _, err := kv.tree.Delete(key); !errors.Is(err, errTestIO) {
+		t.Fatal("delete:", err)
+	}
+	kv.tree.get = get
+	if v, ok, err := kv.tree.Get(key); err != nil || !ok || len(v) != 100 {
+		t.Fatal("failed writes left a change behind", ok, err)
+	}
+}
+
+func TestFailedChangeLeavesTreeIntact(t *testing.T) {
+	var kv KV
+	openKV(t, &kv)
+	defer kv.Close()
+	val := bytes.Repeat([]byte("v"), 200)
+	tx, err := kv.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2000; i++ {
+		if err := tx.Set(testKey(i), val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	tx, err = kv.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	alloc := kv.tree.new
+	for fail := 0; fail < 2; fail++ {
+		// let the change write fail pages, then fail it
+		calls := 0
+		kv.tree.new = func(pg []byte) (uint64, error) {
+			if calls++; calls > fail {
+				return 0, errTestIO
+			}
+			return alloc(pg)
+		}
+		if err := tx.Set([]byte("k00100x"), val); !errors.Is(err, errTestIO) {
+			t.Fatal("set:", err)
+		}
+		calls = 0
+		if _, err := tx.Del(testKey(500 + fail)); !errors.Is(err, errTestIO) {
+			t.Fatal("del:", err)
+		}
+		calls = 0
+		if _, err := tx.DeleteRange(testKey(600), testKey(900)); !errors.Is(err, errTestIO) {
+			t.Fatal("delete range:", err)
+		}
+		calls = 0
+		req := UpdateReq{Key: testKey(300), Val: []byte("x"), Mode: MODE_UPDATE_ONLY}
+		if err := tx.Update(&req); !errors.Is(err, errTestIO) {
+			t.Fatal("update:", err)
+		}
+		kv.tree.new = alloc
+		checkTree(t, &kv.tree)
+	}
+	// what the failed changes freed must not be reused while still in use
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3000; i++ {
+		if err := kv.Set([]byte("j"+string(testKey(i))), val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2000; i++ {
+		v, ok, err := kv.Get(testKey(i))
+		if err != nil || !ok || !bytes.Equal(v, val) {
+			t.Fatal("lost", i, ok, err)
+		}
+	}
+	checkTree(t, &kv.tree)
+}
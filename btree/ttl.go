@@ -0,0 +1,195 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// A leaf cell written by SetWithTTL is marked with VAL_EXPIRES and its
+// value is followed by the expiry time, Unix nanoseconds. Putting it last
+// leaves an overflow reference where the overflow code expects it.
+const (
+	VAL_EXPIRES = 1 << 14
+	EXPIRY_SIZE = 8
+)
+
+// TTL_REAP_BATCH is how many expired keys a commit deletes at most on its
+// way out.
+const TTL_REAP_BATCH = 64
+
+var ErrBadTTL = errors.New("ttl must be positive")
+
+// The expiry index is a second tree keyed by the big-endian expiry time
+// followed by the key, so that the keys due first come first. Entries
+// are not removed when their key is overwritten or deleted; the reaper
+// checks each one against the key before deleting it. The index allows
+// keys EXPIRY_SIZE bytes longer than the main tree does, so that any key
+// the main tree takes can be indexed.
+func expiryKey(expires int64, key []byte) []byte {
+	return append(binary.BigEndian.AppendUint64(nil, uint64(expires)), key...)
+}
+
+// expiresAt returns the expiry time of a leaf cell, zero if it has none.
+func (node BNode) expiresAt(idx uint16) int64 {
+	if node.getFlags(idx)&VAL_EXPIRES == 0 {
+		return 0
+	}
+	val := node.getVal(idx)
+	return int64(binary.LittleEndian.Uint64(val[len(val)-EXPIRY_SIZE:]))
+}
+
+func (node BNode) expired(idx uint16, now int64) bool {
+	at := node.expiresAt(idx)
+	return at != 0 && at <= now
+}
+
+// expiresAt returns the expiry time of the current key, zero if it has
+// none.
+func (it *Iter) expiresAt() int64 {
+	if !it.ok {
+		return 0
+	}
+	return it.leaf.expiresAt(uint16(it.idx))
+}
+
+// SetWithTTL sets key to val until ttl has passed. From then on Get, Scan
+// and iterators no longer see the key, and a later commit deletes it.
+// Until it is deleted it still counts in Rank, CountRange and SeekIndex,
+// but not in what Del and DeleteRange report.
+// Writing the key again with Set drops the expiry.
+func (db *KV) SetWithTTL(key []byte, val []byte, ttl time.Duration) error {
+	if db.ReadOnly {
+		return ErrReadOnly
+	}
+	if ttl <= 0 {
+		return ErrBadTTL
+	}
+	cc := getCC(db)
+	cc.wmu.Lock()
+	db.writeBegin()
+	meta := saveMeta(db)
+	if err := db.setExpiring(key, val, time.Now().Add(ttl).UnixNano()); err != nil {
+		revertMeta(db, meta)
+		cc.wmu.Unlock()
+		return err
+	}
+	return commitWrite(db, meta, cc.wmu.Unlock)
+}
+
+// setExpiring writes key with an expiry time, or without one if expires
+// is zero, and indexes it.
+func (db *KV) setExpiring(key []byte, val []byte, expires int64) error {
+	if err := db.tree.insert(key, val, expires); err != nil {
+		return err
+	}
+	if expires == 0 {
+		return nil
+	}
+	return db.ttl.Insert(expiryKey(expires, key), nil)
+}
+
+// deleteRange deletes the keys in [start, end) and returns the number of
+// those that had not expired, then of all of them. The expired ones are
+// counted through the expiry index, as the subtrees DeleteRange unlinks
+// are never read.
+func (db *KV) deleteRange(start []byte, end []byte) (int, int, error) {
+	expired, err := db.expiredIn(start, end, time.Now().UnixNano())
+	if err != nil {
+		return 0, 0, err
+	}
+	n, err := db.tree.DeleteRange(start, end)
+	if err != nil {
+		return 0, 0, err
+	}
+	return n - expired, n, nil
+}
+
+// expiredIn counts the keys in [start, end) that expired at or before now
+// and are yet to be reaped.
+func (db *KV) expiredIn(start []byte, end []byte, now int64) (int, error) {
+	if db.ttl.root == 0 {
+		return 0, nil
+	}
+	n := 0
+	it := NewIter(&db.ttl)
+	defer it.Close()
+	for ok := it.SeekGE(nil, nil); ok; ok = it.Next() {
+		at, key := int64(binary.BigEndian.Uint64(it.Key())), it.Key()[8:]
+		if at > now {
+			break
+		}
+		if start != nil && bytes.Compare(key, start) < 0 || end != nil && bytes.Compare(key, end) >= 0 {
+			continue
+		}
+		node, idx, ok, err := db.tree.lookup(key)
+		if err != nil {
+			return 0, err
+		}
+		if ok && node.expiresAt(idx) == at {
+			n++
+		}
+	}
+	return n, it.Err()
+}
+
+// Reap deletes up to limit expired keys in one commit and returns how many
+// it deleted. Commits already reap a few keys each; Reap is for catching
+// up when the database sees few writes.
+func (db *KV) Reap(limit int) (int, error) {
+	if db.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	cc := getCC(db)
+	cc.wmu.Lock()
+	db.writeBegin()
+	meta := saveMeta(db)
+	n, done, err := db.reap(limit)
+	if err != nil || done == 0 {
+		revertMeta(db, meta)
+		cc.wmu.Unlock()
+		return 0, err
+	}
+	return n, commitTx(db, meta, cc.wmu.Unlock)
+}
+
+// reap works through the expiry index entries that are due, at most limit
+// of them, and deletes each key that still expires at the time of its
+// entry. It returns the number of keys and of entries it deleted.
+func (db *KV) reap(limit int) (int, int, error) {
+	if db.ttl.root == 0 || limit <= 0 {
+		return 0, 0, nil
+	}
+	now := time.Now().UnixNano()
+	var due [][]byte
+	it := NewIter(&db.ttl)
+	for ok := it.SeekGE(nil, nil); ok && len(due) < limit; ok = it.Next() {
+		if int64(binary.BigEndian.Uint64(it.Key())) > now {
+			break
+		}
+		due = append(due, bytes.Clone(it.Key()))
+	}
+	it.Close()
+	if err := it.Err(); err != nil {
+		return 0, 0, err
+	}
+	n := 0
+	for _, ekey := range due {
+		at, key := int64(binary.BigEndian.Uint64(ekey)), ekey[8:]
+		node, idx, ok, err := db.tree.lookup(key)
+		if err != nil {
+			return 0, 0, err
+		}
+		if ok && node.expiresAt(idx) == at {
+			if _, err := db.tree.delete(key, 0); err != nil {
+				return 0, 0, err
+			}
+			n++
+		}
+		if _, err := db.ttl.Delete(ekey); err != nil {
+			return 0, 0, err
+		}
+	}
+	return n, len(due), nil
+}
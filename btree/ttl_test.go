@@ -0,0 +1,264 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// ttlKeys is the number of entries in the expiry index.
+func ttlKeys(t *testing.T, kv *KV) int {
+	t.Helper()
+	n := 0
+	it := NewIter(&kv.ttl)
+	defer it.Close()
+	for ok := it.SeekGE(nil, nil); ok; ok = it.Next() {
+		n++
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+const testTTL = 300 * time.Millisecond
+
+// expiring commits 300 keys s0000..s0299 in one transaction. The even ones
+// expire after testTTL and the odd ones in an hour. It returns the time by
+// which the even ones are gone.
+func expiring(t *testing.T, kv *KV) time.Time {
+	t.Helper()
+	tx, err := kv.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 300; i++ {
+		k := []byte(fmt.Sprintf("s%04d", i))
+		v := []byte(fmt.Sprintf("v%d", i))
+		if i%50 == 0 {
+			v = bytes.Repeat([]byte("B"), 9000)
+		}
+		ttl := time.Hour
+		if i%2 == 0 {
+			ttl = testTTL
+		}
+		if err := tx.SetWithTTL(k, v, ttl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	due := time.Now().Add(testTTL)
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return due
+}
+
+func TestExpiredKeysAreInvisible(t *testing.T) {
+	kv := KV{}
+	openKV(t, &kv)
+	defer kv.Close()
+	due := expiring(t, &kv)
+	tx, err := kv.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := tx.Set([]byte(fmt.Sprintf("p%04d", i)), []byte("perm")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// overwriting drops the expiry
+	if err := tx.Set([]byte("s0002"), []byte("kept")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := kv.Get([]byte("s0004")); err != nil || !ok {
+		t.Fatalf("s0004 gone before its time: %v", err)
+	}
+	time.Sleep(time.Until(due.Add(50 * time.Millisecond)))
+
+	const want = 150 + 50 + 1
+	count := func(scan func(start, end []byte, fn ScanFn) error) int {
+		t.Helper()
+		n := 0
+		if err := scan(nil, nil, func(k, v []byte) bool {
+			var i int
+			if _, err := fmt.Sscanf(string(k), "s%04d", &i); err == nil && i%2 == 0 && i != 2 {
+				t.Fatalf("expired key %q visible", k)
+			}
+			n++
+			return true
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if n := count(kv.Scan); n != want {
+		t.Fatalf("scan: %d keys, want %d", n, want)
+	}
+	if n := count(kv.ScanReverse); n != want {
+		t.Fatalf("reverse scan: %d keys, want %d", n, want)
+	}
+	if _, ok, err := kv.Get([]byte("s0004")); err != nil || ok {
+		t.Fatalf("expired s0004 visible: %v", err)
+	}
+	if v, ok, err := kv.Get([]byte("s0002")); err != nil || !ok || string(v) != "kept" {
+		t.Fatalf("overwritten s0002: %q %v", v, err)
+	}
+
+	rt := kv.BeginReadTx()
+	it := rt.NewIter()
+	steps := []struct {
+		move func() bool
+		want string
+	}{
+		{func() bool { return it.SeekLE([]byte("s0004"), nil) }, "s0003"},
+		{func() bool { return it.SeekGE([]byte("s0004"), nil) }, "s0005"},
+		{it.Next, "s0007"},
+		{it.Prev, "s0005"},
+	}
+	for i, s := range steps {
+		if !s.move() || string(it.Key()) != s.want {
+			t.Fatalf("step %d: at %q, want %q", i, it.Key(), s.want)
+		}
+	}
+	it.Close()
+	rt.End()
+
+	tx, err = kv.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if _, ok, err := tx.Get([]byte("s0004")); err != nil || ok {
+		t.Fatalf("expired s0004 visible in a tx: %v", err)
+	}
+	if n := count(tx.Scan); n != want {
+		t.Fatalf("tx scan: %d keys, want %d", n, want)
+	}
+	// an expired key counts as absent
+	req := UpdateReq{Key: []byte("s0006"), Val: []byte("new"), Mode: MODE_INSERT_ONLY}
+	if err := tx.Update(&req); err != nil || !req.Applied || !req.Added {
+		t.Fatalf("insert over an expired key: applied %v, added %v: %v", req.Applied, req.Added, err)
+	}
+}
+
+func TestExpiredKeysAreReaped(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		t.Run(fmt.Sprintf("wal=%v", wal), func(t *testing.T) {
+			kv := KV{WAL: wal}
+			openKV(t, &kv)
+			defer kv.Close()
+			due := expiring(t, &kv)
+			if n := ttlKeys(t, &kv); n != 300 {
+				t.Fatalf("%d keys indexed", n)
+			}
+			// the index is kept across a reopen
+			kv.Close()
+			openKV(t, &kv)
+			if n := ttlKeys(t, &kv); n != 300 {
+				t.Fatalf("%d keys indexed after a reopen", n)
+			}
+			time.Sleep(time.Until(due.Add(50 * time.Millisecond)))
+
+			// every commit reaps a batch
+			if err := kv.Set([]byte("q"), []byte("q")); err != nil {
+				t.Fatal(err)
+			}
+			if n := ttlKeys(t, &kv); n != 300-TTL_REAP_BATCH {
+				t.Fatalf("%d keys indexed after a commit", n)
+			}
+			total := TTL_REAP_BATCH
+			for {
+				n, err := kv.Reap(40)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n == 0 {
+					break
+				}
+				total += n
+			}
+			if total != 150 || ttlKeys(t, &kv) != 150 {
+				t.Fatalf("%d keys reaped, %d left in the index", total, ttlKeys(t, &kv))
+			}
+			if _, _, ok, err := kv.tree.lookup([]byte("s0004")); err != nil || ok {
+				t.Fatalf("expired s0004 still stored: %v", err)
+			}
+			if n, err := kv.CountRange(nil, nil); err != nil || n != 151 {
+				t.Fatalf("%d keys left: %v", n, err)
+			}
+			checkTree(t, &kv.tree)
+			checkTree(t, &kv.ttl)
+		})
+	}
+}
+
+func TestSetWithTTLLimits(t *testing.T) {
+	kv := KV{}
+	openKV(t, &kv)
+	defer kv.Close()
+	if err := kv.SetWithTTL([]byte("x"), []byte("x"), 0); err != ErrBadTTL {
+		t.Fatalf("zero ttl: %v", err)
+	}
+	// the index entry has room for a key of the maximum size
+	k := bytes.Repeat([]byte("k"), maxKeySize(kv.tree.pageSize))
+	if err := kv.SetWithTTL(k, []byte("v"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if n := ttlKeys(t, &kv); n != 1 {
+		t.Fatalf("%d keys indexed", n)
+	}
+	if err := kv.SetWithTTL(append(k, 'x'), []byte("v"), time.Hour); err == nil {
+		t.Fatal("a key past the limit was taken")
+	}
+}
+
+// Del and DeleteRange report only the live keys they delete.
+func TestDeleteSkipsExpiredKeys(t *testing.T) {
+	kv := KV{}
+	openKV(t, &kv)
+	defer kv.Close()
+	tx, err := kv.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		ttl := time.Hour
+		if i%3 == 0 {
+			ttl = 20 * time.Millisecond
+		}
+		if err := tx.SetWithTTL([]byte(fmt.Sprintf("k%03d", i)), []byte("v"), ttl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if ok, err := kv.Del([]byte("k000")); err != nil || ok {
+		t.Fatalf("deleted the expired k000: %v", err)
+	}
+	if ok, err := kv.Del([]byte("k001")); err != nil || !ok {
+		t.Fatalf("did not delete k001: %v", err)
+	}
+	// 200 live keys of the 300 in [k100, k400)
+	if n, err := kv.DeleteRange([]byte("k100"), []byte("k400")); err != nil || n != 200 {
+		t.Fatalf("%d deleted in [k100, k400): %v", n, err)
+	}
+	tx, err = kv.BeginWrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 333 live keys, less k001 and the 200 above
+	if n, err := tx.DeleteRange(nil, nil); err != nil || n != 132 {
+		t.Fatalf("%d deleted in the tx: %v", n, err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, &kv.tree)
+}
@@ -2,11 +2,14 @@ package btree
 
 import (
 	"errors"
-	"os"
+	"time"
 )
 
 var ErrTxClosed = errors.New("tx closed")
 
+// ErrReadOnly is returned by every write to a KV opened with ReadOnly.
+var ErrReadOnly = errors.New("database is open read-only")
+
 type Tx struct {
 	db      *KV
 	meta    []byte
@@ -14,30 +17,43 @@ type Tx struct {
 	release func()
 }
 
-func (db *KV) ensureInit() {
-	if db.Path == "" {
-		return
+// ensureInit writes the first free list page of a new database, an empty
+// list node checksummed and sealed like any other page, so that every
+// page the database reads has been written.
+func (db *KV) ensureInit() error {
+	if db.file == nil {
+		return nil
 	}
-	st, err := os.Stat(db.Path)
+	st, err := db.file.Stat()
 	if err != nil {
-		return
+		return err
 	}
-	if st.Size() >= int64(2*BTREE_PAGE_SIZE) {
-		return
+	_, head := db.initLayout()
+	off, size := db.fileRange(head)
+	if st.Size() >= off+int64(size) {
+		return nil
 	}
-	f, err := os.OpenFile(db.Path, os.O_RDWR|os.O_CREATE, 0o666)
+	pg := make([]byte, db.page.size)
+	pageSetChecksum(pg)
+	data, err := db.packPage(head, pg)
 	if err != nil {
-		return
+		return err
+	}
+	if _, err := db.file.WriteAt(data, off); err != nil {
+		return err
 	}
-	defer f.Close()
-	buf := make([]byte, BTREE_PAGE_SIZE)
-	_, _ = f.WriteAt(buf, int64(BTREE_PAGE_SIZE))
-	_ = f.Sync()
+	return db.file.Sync()
 }
 
-func (db *KV) Begin() *Tx {
-	db.ensureInit()
-	return &Tx{db: db, meta: saveMeta(db)}
+func (db *KV) Begin() (*Tx, error) {
+	if db.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	if err := db.ensureInit(); err != nil {
+		return nil, err
+	}
+	db.writeBegin()
+	return &Tx{db: db, meta: saveMeta(db)}, nil
 }
 
 func (tx *Tx) Set(key []byte, val []byte) error {
@@ -47,6 +63,31 @@ func (tx *Tx) Set(key []byte, val []byte) error {
 	return tx.db.tree.Insert(key, val)
 }
 
+func (tx *Tx) SetWithTTL(key []byte, val []byte, ttl time.Duration) error {
+	if tx.closed {
+		return ErrTxClosed
+	}
+	if ttl <= 0 {
+		return ErrBadTTL
+	}
+	return tx.db.setExpiring(key, val, time.Now().Add(ttl).UnixNano())
+}
+
+func (tx *Tx) DeleteRange(start []byte, end []byte) (int, error) {
+	if tx.closed {
+		return 0, ErrTxClosed
+	}
+	live, _, err := tx.db.deleteRange(start, end)
+	return live, err
+}
+
+func (tx *Tx) Update(req *UpdateReq) error {
+	if tx.closed {
+		return ErrTxClosed
+	}
+	return tx.db.tree.Update(req)
+}
+
 func (tx *Tx) Del(key []byte) (bool, error) {
 	if tx.closed {
 		return false, ErrTxClosed
@@ -54,28 +95,81 @@ func (tx *Tx) Del(key []byte) (bool, error) {
 	return tx.db.tree.Delete(key)
 }
 
-func (tx *Tx) Commit() error {
+func (tx *Tx) BulkLoad(src BulkSource) error {
 	if tx.closed {
 		return ErrTxClosed
 	}
-	tx.closed = true
-	err := updateOrRevert(tx.db, tx.meta)
-	if tx.release != nil {
-		tx.release()
-		tx.release = nil
+	// a failed load leaves the tree as it was, so drop its changes too
+	n := len(tx.db.changes)
+	err := tx.db.tree.BulkLoad(src)
+	if err != nil {
+		tx.db.changes = tx.db.changes[:n]
 	}
 	return err
 }
 
+// Get, Scan and NewIter see the transaction's own writes on top of the
+// state it began from. An iterator walks the tree as it was when it last
+// seeked; writes made after that show up once it seeks again.
+func (tx *Tx) Get(key []byte) ([]byte, bool, error) {
+	if tx.closed {
+		return nil, false, ErrTxClosed
+	}
+	return tx.db.tree.Get(key)
+}
+
+func (tx *Tx) Scan(start, end []byte, fn ScanFn) error {
+	if tx.closed {
+		return ErrTxClosed
+	}
+	return scanTree(&tx.db.tree, start, end, fn)
+}
+
+func (tx *Tx) ScanReverse(start, end []byte, fn ScanFn) error {
+	if tx.closed {
+		return ErrTxClosed
+	}
+	return scanTreeReverse(&tx.db.tree, start, end, fn)
+}
+
+func (tx *Tx) Rank(key []byte) (int, error) {
+	if tx.closed {
+		return 0, ErrTxClosed
+	}
+	return tx.db.tree.Rank(key)
+}
+
+func (tx *Tx) CountRange(start, end []byte) (int, error) {
+	if tx.closed {
+		return 0, ErrTxClosed
+	}
+	return tx.db.tree.CountRange(start, end)
+}
+
+// NewIter on a closed tx gives an iterator that finds nothing and whose
+// Err is ErrTxClosed.
+func (tx *Tx) NewIter() *Iter {
+	if tx.closed {
+		return &Iter{err: ErrTxClosed}
+	}
+	return NewIter(&tx.db.tree)
+}
+
+func (tx *Tx) Commit() error {
+	if tx.closed {
+		return ErrTxClosed
+	}
+	tx.closed = true
+	release := tx.release
+	tx.release = nil
+	return commitWrite(tx.db, tx.meta, release)
+}
+
 func (tx *Tx) Rollback() {
 	if tx.closed {
 		return
 	}
-	loadMeta(tx.db, tx.meta)
-	tx.db.page.umu.Lock()
-	tx.db.page.updates = make(map[uint64][]byte)
-	tx.db.page.nappend = 0
-	tx.db.page.umu.Unlock()
+	revertMeta(tx.db, tx.meta)
 	tx.closed = true
 	if tx.release != nil {
 		tx.release()
@@ -84,7 +178,10 @@ func (tx *Tx) Rollback() {
 }
 
 func (db *KV) Do(fn func(*Tx) error) error {
-	tx := db.Begin()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
 	if err := fn(tx); err != nil {
 		tx.Rollback()
 		return err
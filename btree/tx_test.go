@@ -0,0 +1,102 @@
+package btree
+
+import "testing"
+
+func scanKeys(t *testing.T, scan func(start, end []byte, fn ScanFn) error) string {
+	t.Helper()
+	var keys string
+	err := scan(nil, nil, func(k, v []byte) bool {
+		keys += string(k)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestTxReadsItsOwnWrites(t *testing.T) {
+	kv := KV{}
+	openKV(t, &kv)
+	defer kv.Close()
+	for _, k := range []string{"a", "c"} {
+		if err := kv.Set([]byte(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tx, err := kv.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Set([]byte("b"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Del([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok, err := tx.Get([]byte("b")); err != nil || !ok || string(v) != "2" {
+		t.Fatalf("tx get b: %q %v %v", v, ok, err)
+	}
+	if _, ok, err := tx.Get([]byte("a")); err != nil || ok {
+		t.Fatalf("tx get a: %v %v", ok, err)
+	}
+	if keys := scanKeys(t, tx.Scan); keys != "bc" {
+		t.Fatalf("tx scan: %q", keys)
+	}
+	it := tx.NewIter()
+	if !it.SeekGE(nil, nil) || string(it.Key()) != "b" {
+		t.Fatalf("tx iter starts at %q", it.Key())
+	}
+	it.Close()
+
+	// others keep seeing the last commit
+	if _, ok, err := kv.Get([]byte("b")); err != nil || ok {
+		t.Fatalf("kv sees uncommitted b: %v", err)
+	}
+	if keys := scanKeys(t, kv.Scan); keys != "ac" {
+		t.Fatalf("kv scan: %q", keys)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tx.Get([]byte("b")); err != ErrTxClosed {
+		t.Fatalf("get after commit: %v", err)
+	}
+	it = tx.NewIter()
+	if it.SeekGE(nil, nil) || it.SeekLE(nil, nil) || it.SeekIndex(0) || it.Err() != ErrTxClosed {
+		t.Fatalf("iterator after commit: %v", it.Err())
+	}
+	it.Close()
+	if keys := scanKeys(t, kv.Scan); keys != "bc" {
+		t.Fatalf("kv scan after commit: %q", keys)
+	}
+}
+
+func TestTxRollback(t *testing.T) {
+	kv := KV{}
+	openKV(t, &kv)
+	defer kv.Close()
+	if err := kv.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := kv.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Set([]byte("a"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Set([]byte("b"), []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+	if err := tx.Set([]byte("c"), nil); err != ErrTxClosed {
+		t.Fatalf("set after rollback: %v", err)
+	}
+	checkModel(t, &kv, map[string]string{"a": "1"})
+	// the writer lock is free again
+	if err := kv.Set([]byte("d"), []byte("4")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,76 @@
+package btree
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestUpdateModes(t *testing.T) {
+	kv := KV{}
+	openKV(t, &kv)
+	defer kv.Close()
+	big := bytes.Repeat([]byte("B"), 9000)
+	steps := []struct {
+		req            UpdateReq
+		applied, added bool
+		old            []byte
+	}{
+		{UpdateReq{Key: []byte("a"), Val: []byte("1"), Mode: MODE_UPDATE_ONLY}, false, false, nil},
+		{UpdateReq{Key: []byte("a"), Val: []byte("1"), Mode: MODE_INSERT_ONLY}, true, true, nil},
+		{UpdateReq{Key: []byte("a"), Val: []byte("2"), Mode: MODE_INSERT_ONLY}, false, false, []byte("1")},
+		{UpdateReq{Key: []byte("a"), Val: big, Mode: MODE_UPDATE_ONLY}, true, false, []byte("1")},
+		// the old value comes back from its overflow pages
+		{UpdateReq{Key: []byte("a"), Val: []byte("3"), Mode: MODE_CAS, Expect: []byte("1")}, false, false, big},
+		{UpdateReq{Key: []byte("a"), Val: []byte("3"), Mode: MODE_CAS, Expect: big}, true, false, big},
+		{UpdateReq{Key: []byte("b"), Val: []byte("3"), Mode: MODE_CAS}, false, false, nil},
+		{UpdateReq{Key: []byte("b"), Val: []byte("4"), Mode: MODE_UPSERT}, true, true, nil},
+		{UpdateReq{Key: []byte("b"), Val: []byte("5")}, true, false, []byte("4")},
+	}
+	for i, s := range steps {
+		seq, root := kv.seq, kv.tree.root
+		if err := kv.Update(&s.req); err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		if s.req.Applied != s.applied || s.req.Added != s.added || !bytes.Equal(s.req.Old, s.old) {
+			t.Fatalf("step %d: applied %v, added %v, old of %d bytes", i, s.req.Applied, s.req.Added, len(s.req.Old))
+		}
+		if (kv.seq != seq) != s.applied {
+			t.Fatalf("step %d: committed %v", i, kv.seq != seq)
+		}
+		if !s.applied && kv.tree.root != root {
+			t.Fatalf("step %d: a declined update rewrote the tree", i)
+		}
+	}
+	checkModel(t, &kv, map[string]string{"a": "3", "b": "5"})
+	if err := kv.Update(&UpdateReq{Key: []byte("x"), Mode: 9}); err == nil {
+		t.Fatal("an unknown mode was accepted")
+	}
+}
+
+func TestTxUpdateSeesItsOwnWrites(t *testing.T) {
+	kv := KV{}
+	openKV(t, &kv)
+	defer kv.Close()
+	tx, err := kv.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := tx.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	req := UpdateReq{Key: []byte("a"), Val: []byte("2"), Mode: MODE_CAS, Expect: []byte("1")}
+	if err := tx.Update(&req); err != nil {
+		t.Fatal(err)
+	}
+	if !req.Applied || req.Added || string(req.Old) != "1" {
+		t.Fatalf("applied %v, added %v, old %q", req.Applied, req.Added, req.Old)
+	}
+	req = UpdateReq{Key: []byte("a"), Val: []byte("3"), Mode: MODE_INSERT_ONLY}
+	if err := tx.Update(&req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Applied || string(req.Old) != "2" {
+		t.Fatalf("insert over a key: applied %v, old %q", req.Applied, req.Old)
+	}
+}
@@ -0,0 +1,331 @@
+package btree
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"slices"
+	"sync"
+)
+
+const WAL_CHECKPOINT_SIZE = 16 << 20
+
+const walHeaderSize = 8
+
+var errWalRecord = errors.New("bad wal record")
+
+// walState holds page images that are durable in the log but not yet
+// written back to the data file. A record is the commit's meta block
+// followed by every page it staged; one fsync of the log commits it.
+//
+// With compression a reused extent may be logged under a new pointer
+// while its old image is still here, so lsn keeps the sequence of the
+// record that last logged each page and checkpoints write them in order.
+type walState struct {
+	file  *os.File
+	size  int64
+	meta  []byte
+	pages map[uint64][]byte
+	lsn   map[uint64]uint64
+	mu    sync.RWMutex
+}
+
+func walPath(path string) string {
+	return path + "-wal"
+}
+
+// walOpen replays the log. A read-only database keeps the replayed pages
+// in memory and leaves both files as they are.
+func (db *KV) walOpen() error {
+	db.wal.pages = make(map[uint64][]byte)
+	db.wal.lsn = make(map[uint64]uint64)
+	db.wal.size = 0
+	db.wal.meta = nil
+	var f *os.File
+	var err error
+	if db.ReadOnly {
+		f, err = os.Open(walPath(db.Path))
+		if os.IsNotExist(err) {
+			return nil
+		}
+	} else {
+		f, err = os.OpenFile(walPath(db.Path), os.O_RDWR|os.O_CREATE, 0o644)
+	}
+	if err != nil {
+		return err
+	}
+	db.wal.file = f
+	if err := walReplay(db); err != nil {
+		return err
+	}
+	if db.ReadOnly {
+		return nil
+	}
+	if db.wal.meta != nil {
+		return walCheckpoint(db)
+	}
+	db.wal.size = 0
+	return db.wal.file.Truncate(0)
+}
+
+func walReplay(db *KV) error {
+	off := int64(0)
+	for {
+		meta, pages, n, err := walReadRecord(db, off)
+		if err == io.EOF || errors.Is(err, errWalRecord) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("wal replay: %w", err)
+		}
+		off += n
+		db.wal.size = off
+		if metaSeq(meta) <= db.seq {
+			continue
+		}
+		for ptr, pg := range pages {
+			db.wal.pages[ptr] = pg
+			db.wal.lsn[ptr] = metaSeq(meta)
+		}
+		loadMeta(db, meta)
+		db.wal.meta = meta
+	}
+}
+
+func walReadRecord(db *KV, off int64) ([]byte, map[uint64][]byte, int64, error) {
+	f, pageSize := db.wal.file, db.page.size
+	var hdr [walHeaderSize]byte
+	if _, err := f.ReadAt(hdr[:], off); err != nil {
+		if err == io.EOF {
+			return nil, nil, 0, io.EOF
+		}
+		return nil, nil, 0, err
+	}
+	size := binary.LittleEndian.Uint32(hdr[0:])
+	sum := binary.LittleEndian.Uint32(hdr[4:])
+	if int(size) < META_SIZE+4+db.sealOverhead() {
+		return nil, nil, 0, errWalRecord
+	}
+	payload := make([]byte, size)
+	if _, err := f.ReadAt(payload, off+walHeaderSize); err != nil {
+		if err == io.EOF {
+			return nil, nil, 0, errWalRecord
+		}
+		return nil, nil, 0, err
+	}
+	if crc32.Checksum(payload, crcTable) != sum {
+		return nil, nil, 0, errWalRecord
+	}
+	// the checksum catches torn appends; a record that is whole but does
+	// not open has been tampered with
+	payload, err := db.unseal(payload, walAD)
+	if err != nil {
+		return nil, nil, 0, &PageError{Page: 0, Err: ErrCorruptPage}
+	}
+	meta := payload[:META_SIZE]
+	if !metaValid(meta) {
+		return nil, nil, 0, errWalRecord
+	}
+	npages := binary.LittleEndian.Uint32(payload[META_SIZE:])
+	body := payload[META_SIZE+4:]
+	if uint64(len(body)) != uint64(npages)*uint64(8+pageSize) {
+		return nil, nil, 0, errWalRecord
+	}
+	pages := make(map[uint64][]byte, npages)
+	for i := uint32(0); i < npages; i++ {
+		ptr := binary.LittleEndian.Uint64(body)
+		pages[ptr] = body[8 : 8+pageSize]
+		body = body[8+pageSize:]
+	}
+	return meta, pages, int64(walHeaderSize) + int64(size), nil
+}
+
+func walEncode(db *KV, meta []byte, pages map[uint64][]byte) []byte {
+	pageSize := db.page.size
+	size := META_SIZE + 4 + len(pages)*(8+pageSize)
+	body := make([]byte, 0, size)
+	body = append(body, meta...)
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(pages)))
+	for ptr, pg := range pages {
+		body = binary.LittleEndian.AppendUint64(body, ptr)
+		body = append(body, pg[:pageSize]...)
+	}
+	body = db.seal(body, walAD)
+	rec := make([]byte, walHeaderSize, walHeaderSize+len(body))
+	rec = append(rec, body...)
+	binary.LittleEndian.PutUint32(rec[0:], uint32(len(body)))
+	binary.LittleEndian.PutUint32(rec[4:], crc32.Checksum(body, crcTable))
+	return rec
+}
+
+func walPrepare(db *KV) ([]byte, error) {
+	db.page.umu.Lock()
+	upd := db.page.updates
+	db.page.flushed += db.page.nappend
+	db.page.umu.Unlock()
+	for _, pg := range upd {
+		pageSetChecksum(pg)
+	}
+	db.seq++
+	meta := saveMeta(db)
+	rec := walEncode(db, meta, upd)
+	if _, err := db.wal.file.WriteAt(rec, db.wal.size); err != nil {
+		return nil, err
+	}
+	db.wal.mu.Lock()
+	for ptr, pg := range upd {
+		db.wal.pages[ptr] = pg
+		db.wal.lsn[ptr] = db.seq
+	}
+	db.wal.size += int64(len(rec))
+	db.wal.meta = meta
+	db.wal.mu.Unlock()
+	db.page.umu.Lock()
+	db.page.nappend = 0
+	db.page.updates = make(map[uint64][]byte)
+	db.page.umu.Unlock()
+	return meta, nil
+}
+
+// walUndo drops the tail of a record whose append failed, so a later
+// record written at the same offset cannot be followed by stale bytes.
+func walUndo(db *KV) error {
+	if err := db.wal.file.Truncate(db.wal.size); err != nil {
+		return err
+	}
+	return db.wal.file.Sync()
+}
+
+func walRevert(db *KV, meta []byte, size int64) error {
+	if err := db.wal.file.Truncate(size); err != nil {
+		return err
+	}
+	if err := db.wal.file.Sync(); err != nil {
+		return err
+	}
+	db.wal.mu.Lock()
+	db.wal.size = size
+	db.wal.meta = nil
+	if size > 0 {
+		db.wal.meta = meta
+	}
+	db.wal.mu.Unlock()
+	return nil
+}
+
+func (db *KV) walSize() int64 {
+	db.wal.mu.RLock()
+	defer db.wal.mu.RUnlock()
+	return db.wal.size
+}
+
+func (db *KV) walPage(ptr uint64) ([]byte, bool) {
+	if !db.WAL {
+		return nil, false
+	}
+	db.wal.mu.RLock()
+	defer db.wal.mu.RUnlock()
+	pg, ok := db.wal.pages[ptr]
+	return pg, ok
+}
+
+// walCheckpoint copies the logged pages into the data file, publishes the
+// last logged meta block, and only then empties the log.
+func walCheckpoint(db *KV) error {
+	db.wal.mu.RLock()
+	meta := db.wal.meta
+	pages := db.wal.pages
+	lsn := db.wal.lsn
+	db.wal.mu.RUnlock()
+	if meta == nil {
+		return nil
+	}
+	ptrs := make([]uint64, 0, len(pages))
+	for ptr := range pages {
+		ptrs = append(ptrs, ptr)
+	}
+	slices.SortFunc(ptrs, func(a, b uint64) int {
+		return cmp.Or(cmp.Compare(lsn[a], lsn[b]), cmp.Compare(a, b))
+	})
+	for _, ptr := range ptrs {
+		if err := db.writePage(ptr, pages[ptr]); err != nil {
+			return err
+		}
+	}
+	if db.Mmap {
+		if err := db.mmapGrow(int64(metaFlushed(meta)) * int64(db.unitSize())); err != nil {
+			return err
+		}
+	}
+	if err := db.file.Sync(); err != nil {
+		return err
+	}
+	g := db.group()
+	g.mu.Lock()
+	slot := g.slot ^ 1
+	g.mu.Unlock()
+	if err := writeMetaSlot(db, meta, slot); err != nil {
+		return err
+	}
+	if err := db.file.Sync(); err != nil {
+		return err
+	}
+	g.mu.Lock()
+	g.slot = slot
+	g.mu.Unlock()
+	if err := db.wal.file.Truncate(0); err != nil {
+		return err
+	}
+	if err := db.wal.file.Sync(); err != nil {
+		return err
+	}
+	db.wal.mu.Lock()
+	db.wal.pages = make(map[uint64][]byte)
+	db.wal.lsn = make(map[uint64]uint64)
+	db.wal.size = 0
+	db.wal.meta = nil
+	db.wal.mu.Unlock()
+	g.mu.Lock()
+	g.walSize = 0
+	g.durableWal = 0
+	g.mu.Unlock()
+	return nil
+}
+
+func (db *KV) Checkpoint() error {
+	if !db.WAL {
+		return nil
+	}
+	if db.ReadOnly {
+		return ErrReadOnly
+	}
+	cc := getCC(db)
+	cc.wmu.Lock()
+	defer cc.wmu.Unlock()
+	if err := waitIdle(db); err != nil {
+		return err
+	}
+	return walCheckpoint(db)
+}
+
+func (db *KV) walClose() error {
+	if db.wal.file == nil {
+		return nil
+	}
+	var err error
+	if !db.ReadOnly {
+		err = waitIdle(db)
+		if err == nil {
+			err = walCheckpoint(db)
+		}
+	}
+	if cerr := db.wal.file.Close(); err == nil {
+		err = cerr
+	}
+	db.wal.file = nil
+	return err
+}
@@ -0,0 +1,120 @@
+package btree
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+// crashKV drops kv as a crash would, with no checkpoint and no meta
+// update, and returns a KV with the same options as a restarted process
+// would have.
+func crashKV(t *testing.T, kv *KV) KV {
+	t.Helper()
+	if err := kv.mmapClose(); err != nil {
+		t.Fatal(err)
+	}
+	if kv.wal.file != nil {
+		kv.wal.file.Close()
+	}
+	kv.file.Close()
+	return KV{Path: kv.Path, WAL: kv.WAL, Mmap: kv.Mmap, PageSize: kv.PageSize, Compress: kv.Compress, Key: kv.Key}
+}
+
+func walFileSize(t *testing.T, kv *KV) int64 {
+	t.Helper()
+	st, err := os.Stat(walPath(kv.Path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st.Size()
+}
+
+func TestWALReplayAfterCrash(t *testing.T) {
+	kv := KV{WAL: true}
+	openKV(t, &kv)
+	model := map[string]string{}
+	for round := 0; round < 3; round++ {
+		tx, err := kv.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 200; i++ {
+			k, v := testKey((i*7+round)%600), fmt.Sprintf("v%d-%d", round, i)
+			if err := tx.Set(k, []byte(v)); err != nil {
+				t.Fatal(err)
+			}
+			model[string(k)] = v
+		}
+		if _, err := tx.Del(testKey(round * 11)); err != nil {
+			t.Fatal(err)
+		}
+		delete(model, string(testKey(round*11)))
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seq := kv.seq
+	kv = crashKV(t, &kv)
+	if walFileSize(t, &kv) == 0 {
+		t.Fatal("nothing was logged")
+	}
+	openKV(t, &kv)
+	defer kv.Close()
+	if kv.seq != seq {
+		t.Fatalf("replayed up to commit %d, want %d", kv.seq, seq)
+	}
+	checkModel(t, &kv, model)
+	if walFileSize(t, &kv) != 0 {
+		t.Fatal("the log was not checkpointed on open")
+	}
+}
+
+func TestWALTornTailIsDropped(t *testing.T) {
+	kv := KV{WAL: true}
+	openKV(t, &kv)
+	if err := kv.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Set([]byte("b"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	kv = crashKV(t, &kv)
+	if err := os.Truncate(walPath(kv.Path), walFileSize(t, &kv)-10); err != nil {
+		t.Fatal(err)
+	}
+	openKV(t, &kv)
+	defer kv.Close()
+	if _, ok, err := kv.Get([]byte("a")); err != nil || !ok {
+		t.Fatal("a lost", err)
+	}
+	if _, ok, err := kv.Get([]byte("b")); err != nil || ok {
+		t.Fatal("b of the torn record visible", err)
+	}
+}
+
+func TestWALCheckpoint(t *testing.T) {
+	kv := KV{WAL: true}
+	openKV(t, &kv)
+	model := map[string]string{}
+	for i := 0; i < 300; i++ {
+		k := testKey(i)
+		if err := kv.Set(k, k); err != nil {
+			t.Fatal(err)
+		}
+		model[string(k)] = string(k)
+	}
+	if err := kv.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if walFileSize(t, &kv) != 0 || len(kv.wal.pages) != 0 {
+		t.Fatal("the log was not emptied")
+	}
+	checkModel(t, &kv, model)
+	kv.Close()
+	// the data file stands on its own
+	kv.WAL = false
+	openKV(t, &kv)
+	defer kv.Close()
+	checkModel(t, &kv, model)
+}
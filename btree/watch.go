@@ -0,0 +1,270 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Kinds of Event.
+const (
+	EVENT_PUT = 1
+	EVENT_DEL = 2
+)
+
+// WATCH_HISTORY is how many recent events are kept for watchers to read
+// and to resume from. A commit returns only once every watcher is within
+// WATCH_HISTORY events of the last one, waiting up to WATCH_STALL; a
+// watcher still further behind is then cut off and fails with ErrWatchGap.
+// The wait happens after the commit is durable and its locks are let go,
+// so other writers and the sync leader never wait for a watcher.
+const (
+	WATCH_HISTORY = 4096
+	WATCH_STALL   = time.Second
+)
+
+var (
+	ErrWatchGap    = errors.New("watch: events after that sequence number are no longer kept")
+	ErrWatchClosed = errors.New("watch closed")
+)
+
+// Event is a change made by a durable commit. The slices are shared with
+// other watchers and must not be modified.
+type Event struct {
+	Seq  uint64 // the commit, as numbered in the meta block
+	Kind int
+	Key  []byte
+	Val  []byte // nil for EVENT_DEL
+}
+
+// Changes are recorded while a write is in progress, only once someone
+// watches. prepareCommit numbers them and queues them in the commit group,
+// and the sync leader hands over those of the commits it made durable,
+// before giving up its turn, so they are published in commit order.
+// Changes of a commit that is reverted or fails to sync are dropped.
+
+// watchHub keeps the published events. log[0] is event number base of
+// the stream, and each watcher reads it at its own position.
+type watchHub struct {
+	mu       sync.Mutex
+	cond     sync.Cond
+	log      []Event
+	base     uint64
+	floor    uint64 // events of commits up to floor may be missing
+	last     uint64 // the last commit published
+	waiting  int    // committers waiting for a watcher to catch up
+	watchers map[*Watcher]struct{}
+	closed   bool
+}
+
+// Watcher reads the events of the keys under its prefix. It is not safe
+// for use by several goroutines at once, except that Close may be called
+// while Next waits.
+type Watcher struct {
+	hub    *watchHub
+	prefix []byte
+	after  uint64 // events of commits up to this one are skipped
+	pos    uint64
+	closed bool
+}
+
+// Watch returns a watcher for the changes to keys under prefix made by
+// the commits that become durable from now on.
+func (db *KV) Watch(prefix []byte) *Watcher {
+	h := db.watchHub()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.add(prefix, h.last, h.base+uint64(len(h.log)))
+}
+
+// WatchFrom returns a watcher for the changes to keys under prefix made by
+// the commits after seq, typically the Seq of the last event a previous
+// watcher read. It fails with ErrWatchGap once those events are gone.
+//
+// The events are kept in memory only, the last WATCH_HISTORY of them, and
+// only from the first Watch on. WatchFrom therefore resumes a watcher of
+// the same process that fell behind a little; it cannot resume one from
+// before the database was opened, which gets ErrWatchGap. A consumer that
+// must not miss a change across restarts has to read the keys again.
+func (db *KV) WatchFrom(prefix []byte, seq uint64) (*Watcher, error) {
+	h := db.watchHub()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if seq < h.floor {
+		return nil, ErrWatchGap
+	}
+	i := sort.Search(len(h.log), func(i int) bool { return h.log[i].Seq > seq })
+	return h.add(prefix, seq, h.base+uint64(i)), nil
+}
+
+// watchHub starts recording changes the first time it is called. It takes
+// the writer lock so that no write is half recorded.
+func (db *KV) watchHub() *watchHub {
+	cc := getCC(db)
+	g := &cc.group
+	g.mu.Lock()
+	h := g.watch
+	g.mu.Unlock()
+	if h != nil {
+		return h
+	}
+	cc.wmu.Lock()
+	defer cc.wmu.Unlock()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.watch == nil {
+		g.watch = &watchHub{floor: g.prepared, last: g.prepared, watchers: map[*Watcher]struct{}{}}
+		g.watch.cond.L = &g.watch.mu
+		db.tree.watch = db.recordChange
+	}
+	return g.watch
+}
+
+func (db *KV) recordChange(kind int, key []byte, val []byte) {
+	db.changes = append(db.changes, Event{Kind: kind, Key: bytes.Clone(key), Val: bytes.Clone(val)})
+}
+
+// watchClose ends every watcher, for Close.
+func (db *KV) watchClose() {
+	g := db.group()
+	g.mu.Lock()
+	h := g.watch
+	g.watch = nil
+	g.events = nil
+	g.mu.Unlock()
+	db.tree.watch = nil
+	db.changes = nil
+	if h != nil {
+		h.mu.Lock()
+		h.closed = true
+		h.cond.Broadcast()
+		h.mu.Unlock()
+	}
+}
+
+func (h *watchHub) add(prefix []byte, after uint64, pos uint64) *Watcher {
+	w := &Watcher{hub: h, prefix: bytes.Clone(prefix), after: after, pos: pos}
+	h.watchers[w] = struct{}{}
+	return w
+}
+
+// publish appends the events of the commits up to seq. It never waits:
+// the committers hold back until the watchers catch up, in watchWait.
+func (h *watchHub) publish(seq uint64, events []Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	h.log = append(h.log, events...)
+	h.trim()
+	h.last = max(h.last, seq)
+	h.cond.Broadcast()
+}
+
+// trim drops the oldest events beyond WATCH_HISTORY that every watcher
+// has read.
+func (h *watchHub) trim() {
+	drop := len(h.log) - WATCH_HISTORY
+	for w := range h.watchers {
+		drop = min(drop, int(w.pos-h.base))
+	}
+	if drop > 0 {
+		h.floor = max(h.floor, h.log[drop-1].Seq)
+		h.log = h.log[drop:]
+		h.base += uint64(drop)
+	}
+}
+
+// lagging reports whether a watcher is more than WATCH_HISTORY events
+// behind.
+func (h *watchHub) lagging() bool {
+	head := h.base + uint64(len(h.log))
+	for w := range h.watchers {
+		if head-w.pos > WATCH_HISTORY {
+			return true
+		}
+	}
+	return false
+}
+
+// watchWait holds up a committer, which holds no lock by now, while a
+// watcher lags; see WATCH_STALL.
+func (db *KV) watchWait() {
+	g := db.group()
+	g.mu.Lock()
+	h := g.watch
+	g.mu.Unlock()
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed || !h.lagging() {
+		return
+	}
+	deadline := time.Now().Add(WATCH_STALL)
+	timer := time.AfterFunc(WATCH_STALL, func() {
+		h.mu.Lock()
+		h.cond.Broadcast()
+		h.mu.Unlock()
+	})
+	defer timer.Stop()
+	for !h.closed && h.lagging() {
+		if !time.Now().Before(deadline) {
+			// cut off the laggards, which may then fall off the log
+			head := h.base + uint64(len(h.log))
+			for w := range h.watchers {
+				if head-w.pos > WATCH_HISTORY {
+					delete(h.watchers, w)
+				}
+			}
+			h.trim()
+			return
+		}
+		h.waiting++
+		h.cond.Wait()
+		h.waiting--
+	}
+}
+
+// Next waits for the next event under the prefix and returns it. It fails
+// with ErrWatchGap once the watcher is cut off for lagging and the events
+// it has yet to read are dropped, and with ErrWatchClosed once the watcher
+// or the database is closed.
+func (w *Watcher) Next() (Event, error) {
+	h := w.hub
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for {
+		if w.closed || h.closed {
+			return Event{}, ErrWatchClosed
+		}
+		if w.pos < h.base {
+			return Event{}, ErrWatchGap
+		}
+		if w.pos == h.base+uint64(len(h.log)) {
+			h.cond.Wait()
+			continue
+		}
+		ev := h.log[w.pos-h.base]
+		w.pos++
+		if h.waiting > 0 {
+			h.cond.Broadcast()
+		}
+		if ev.Seq > w.after && bytes.HasPrefix(ev.Key, w.prefix) {
+			return ev, nil
+		}
+	}
+}
+
+func (w *Watcher) Close() {
+	h := w.hub
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	w.closed = true
+	delete(h.watchers, w)
+	h.cond.Broadcast()
+}
@@ -0,0 +1,317 @@
+package btree
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// nextEvent waits a while for the next event of w.
+func nextEvent(t *testing.T, w *Watcher) Event {
+	t.Helper()
+	type result struct {
+		ev  Event
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		ev, err := w.Next()
+		ch <- result{ev, err}
+	}()
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		return r.ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+	return Event{}
+}
+
+func expectEvent(t *testing.T, w *Watcher, kind int, key, val string) Event {
+	t.Helper()
+	ev := nextEvent(t, w)
+	if ev.Kind != kind || string(ev.Key) != key || (kind == EVENT_PUT && string(ev.Val) != val) {
+		t.Fatalf("event %d %q %q, want %d %q %q", ev.Kind, ev.Key, ev.Val, kind, key, val)
+	}
+	return ev
+}
+
+// putMany commits n keys made with format, 100 to a transaction.
+func putMany(t *testing.T, kv *KV, format string, n int) {
+	t.Helper()
+	for i := 0; i < n; i += 100 {
+		tx, err := kv.BeginWrite()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := i; j < min(i+100, n); j++ {
+			if err := tx.Set([]byte(fmt.Sprintf(format, j)), []byte("x")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Every way of writing reports its changes, once committed, in commit
+// order.
+func TestWatchEvents(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		t.Run(fmt.Sprintf("wal=%v", wal), func(t *testing.T) {
+			kv := KV{WAL: wal}
+			openKV(t, &kv)
+			defer kv.Close()
+			if err := kv.Set([]byte("a0"), []byte("before")); err != nil {
+				t.Fatal(err)
+			}
+			w := kv.Watch([]byte("a"))
+			defer w.Close()
+			kv.Set([]byte("a1"), []byte("1"))
+			kv.Set([]byte("b1"), []byte("x"))
+			kv.Del([]byte("a0"))
+			kv.Del([]byte("a9")) // absent, no event
+			tx, _ := kv.BeginWrite()
+			tx.Set([]byte("a2"), []byte("2"))
+			tx.Rollback()
+			tx, _ = kv.BeginWrite()
+			tx.Set([]byte("a3"), []byte("3"))
+			tx.Set([]byte("a4"), []byte("4"))
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			var b WriteBatch
+			b.Put([]byte("a5"), []byte("5"))
+			b.Delete([]byte("a3"))
+			if err := kv.Apply(&b); err != nil {
+				t.Fatal(err)
+			}
+			kv.Update(&UpdateReq{Key: []byte("a1"), Val: []byte("no"), Mode: MODE_INSERT_ONLY})
+			kv.Update(&UpdateReq{Key: []byte("a1"), Val: []byte("yes"), Mode: MODE_UPDATE_ONLY})
+			if err := kv.BulkLoad(sliceSource([]string{"a6", "a7"}, map[string]string{"a6": "6", "a7": "7"})); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := kv.DeleteRange([]byte("a4"), []byte("a7")); err != nil {
+				t.Fatal(err)
+			}
+
+			e1 := expectEvent(t, w, EVENT_PUT, "a1", "1")
+			e2 := expectEvent(t, w, EVENT_DEL, "a0", "")
+			if e2.Seq <= e1.Seq {
+				t.Fatalf("commit %d after commit %d", e2.Seq, e1.Seq)
+			}
+			e3 := expectEvent(t, w, EVENT_PUT, "a3", "3")
+			e4 := expectEvent(t, w, EVENT_PUT, "a4", "4")
+			if e3.Seq != e4.Seq {
+				t.Fatal("one transaction under two commits")
+			}
+			expectEvent(t, w, EVENT_PUT, "a5", "5")
+			expectEvent(t, w, EVENT_DEL, "a3", "")
+			expectEvent(t, w, EVENT_PUT, "a1", "yes")
+			expectEvent(t, w, EVENT_PUT, "a6", "6")
+			expectEvent(t, w, EVENT_PUT, "a7", "7")
+			expectEvent(t, w, EVENT_DEL, "a4", "")
+			expectEvent(t, w, EVENT_DEL, "a5", "")
+			expectEvent(t, w, EVENT_DEL, "a6", "")
+		})
+	}
+}
+
+func TestWatchExpiry(t *testing.T) {
+	kv := KV{}
+	openKV(t, &kv)
+	defer kv.Close()
+	w := kv.Watch([]byte("t"))
+	defer w.Close()
+	if err := kv.SetWithTTL([]byte("t1"), []byte("t"), 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, w, EVENT_PUT, "t1", "t")
+	time.Sleep(30 * time.Millisecond)
+	// the next commit reaps it
+	if err := kv.Set([]byte("x"), nil); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, w, EVENT_DEL, "t1", "")
+}
+
+func TestWatchFrom(t *testing.T) {
+	kv := KV{}
+	openKV(t, &kv)
+	defer kv.Close()
+	if err := kv.Set([]byte("a0"), nil); err != nil {
+		t.Fatal(err)
+	}
+	// nothing is kept from before the first watcher
+	if _, err := kv.WatchFrom(nil, 0); err != ErrWatchGap {
+		t.Fatalf("history from before the first watcher: %v", err)
+	}
+	w := kv.Watch(nil)
+	for _, k := range []string{"a1", "a2", "a3"} {
+		if err := kv.Set([]byte(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := expectEvent(t, w, EVENT_PUT, "a1", "a1")
+	w.Close()
+	if _, err := w.Next(); err != ErrWatchClosed {
+		t.Fatalf("Next after Close: %v", err)
+	}
+	w, err := kv.WatchFrom(nil, first.Seq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, w, EVENT_PUT, "a2", "a2")
+	expectEvent(t, w, EVENT_PUT, "a3", "a3")
+	w.Close()
+
+	// the history is bounded, even with no watcher left to read it
+	putMany(t, &kv, "h%05d", WATCH_HISTORY+200)
+	if _, err := kv.WatchFrom(nil, first.Seq); err != ErrWatchGap {
+		t.Fatalf("resumed past the history: %v", err)
+	}
+	if n := len(kv.group().watch.log); n > WATCH_HISTORY {
+		t.Fatalf("%d events kept", n)
+	}
+}
+
+// A watcher that falls behind holds up the commits until it catches up.
+func TestWatchBackpressure(t *testing.T) {
+	kv := KV{}
+	openKV(t, &kv)
+	defer kv.Close()
+	w := kv.Watch(nil)
+	defer w.Close()
+	const n = 3 * WATCH_HISTORY
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < n; i += 100 {
+			tx, err := kv.BeginWrite()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for j := i; j < i+100; j++ {
+				tx.Set([]byte(fmt.Sprintf("b%05d", j)), nil)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	// wait for the writer to wait for the watcher
+	h := kv.group().watch
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		h.mu.Lock()
+		waiting, ahead := h.waiting, h.base+uint64(len(h.log))-w.pos
+		h.mu.Unlock()
+		if ahead > WATCH_HISTORY+100 {
+			t.Fatalf("the writer ran %d events ahead of the watcher", ahead)
+		}
+		if waiting > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the writer never waited")
+		}
+	}
+	for i := 0; i < n; i++ {
+		expectEvent(t, w, EVENT_PUT, fmt.Sprintf("b%05d", i), "")
+	}
+	<-done
+}
+
+// A watcher that stays behind holds up commits for WATCH_STALL only, and
+// is then cut off with ErrWatchGap.
+func TestLaggingWatcherIsCutOff(t *testing.T) {
+	kv := KV{}
+	openKV(t, &kv)
+	defer kv.Close()
+	slow := kv.Watch(nil)
+	defer slow.Close()
+	start := time.Now()
+	putMany(t, &kv, "p%05d", 2*WATCH_HISTORY)
+	if time.Since(start) < WATCH_STALL {
+		t.Fatal("the commits did not wait for the watcher")
+	}
+	if _, err := slow.Next(); err != ErrWatchGap {
+		t.Fatalf("slow watcher: %v", err)
+	}
+	// a goroutine that reads its own watcher as it commits never waits
+	self := kv.Watch([]byte("s"))
+	defer self.Close()
+	start = time.Now()
+	for i := 0; i < 10; i++ {
+		k := fmt.Sprintf("s%d", i)
+		if err := kv.Set([]byte(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+		expectEvent(t, self, EVENT_PUT, k, k)
+	}
+	if time.Since(start) >= WATCH_STALL {
+		t.Fatal("the commits waited for a watcher that keeps up")
+	}
+}
+
+func TestWatchConcurrentWriters(t *testing.T) {
+	kv := KV{}
+	openKV(t, &kv)
+	defer kv.Close()
+	w := kv.Watch([]byte("w"))
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				k := []byte(fmt.Sprintf("w%d-%03d", g, i))
+				if err := kv.Set(k, k); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(g)
+	}
+	var seq uint64
+	next := map[int]int{}
+	for n := 0; n < 400; n++ {
+		ev := nextEvent(t, w)
+		if ev.Seq < seq {
+			t.Fatalf("commit %d after commit %d", ev.Seq, seq)
+		}
+		seq = ev.Seq
+		var g, i int
+		if _, err := fmt.Sscanf(string(ev.Key), "w%d-%d", &g, &i); err != nil {
+			t.Fatal(err)
+		}
+		if next[g] != i {
+			t.Fatalf("writer %d: key %d before key %d", g, i, next[g])
+		}
+		next[g]++
+	}
+	wg.Wait()
+
+	// closing the database wakes a waiting watcher
+	errc := make(chan error)
+	go func() {
+		_, err := w.Next()
+		errc <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	kv.Close()
+	select {
+	case err := <-errc:
+		if err != ErrWatchClosed {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close did not wake the watcher")
+	}
+}
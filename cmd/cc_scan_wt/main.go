@@ -17,7 +17,8 @@ func must(err error) {
 }
 
 func seed(kv *btree.KV, n int, vlen int) {
-	tx := kv.BeginWrite()
+	tx, err := kv.BeginWrite()
+	must(err)
 	for i := 0; i < n; i++ {
 		k := fmt.Sprintf("k%06d", i)
 		v := make([]byte, vlen)
@@ -27,9 +28,9 @@ func seed(kv *btree.KV, n int, vlen int) {
 	_ = tx.Commit()
 }
 
-func scanCount(kv *btree.KV) int {
+func scanCount(scan func(start, end []byte, fn btree.ScanFn) error) int {
 	cnt := 0
-	kv.Scan([]byte("k000000"), []byte("k999999"), func(k, v []byte) bool {
+	scan([]byte("k000000"), []byte("k999999"), func(k, v []byte) bool {
 		cnt++
 		return true
 	})
@@ -37,7 +38,8 @@ func scanCount(kv *btree.KV) int {
 }
 
 func churn(kv *btree.KV, start, count int, delEvery int) {
-	tx := kv.BeginWrite()
+	tx, err := kv.BeginWrite()
+	must(err)
 	for i := start; i < start+count; i++ {
 		k := fmt.Sprintf("k%06d", rand.Intn(start+count))
 		if delEvery > 0 && i%delEvery == 0 {
@@ -59,7 +61,7 @@ func main() {
 
 	seed(&kv, 20000, 32)
 
-	r := kv.BeginRead()
+	r := kv.BeginReadTx()
 	done := make(chan struct{})
 	go func() {
 		t0 := time.Now()
@@ -69,11 +71,11 @@ func main() {
 	}()
 
 	t0 := time.Now()
-	c1 := scanCount(&kv)
+	c1 := scanCount(r.Scan)
 	fmt.Println("snapshot scan count:", c1, "elapsed:", time.Since(t0))
 	r.End()
 
 	<-done
-	c2 := scanCount(&kv)
+	c2 := scanCount(kv.Scan)
 	fmt.Println("post-commit scan count:", c2)
 }
@@ -19,23 +19,35 @@ func size(path string) int64 {
 	return fi.Size()
 }
 
+// check stops the tool on the first failed write, so it never reports on
+// a run that did not happen.
+func check(what string, err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", what, err)
+		os.Exit(1)
+	}
+}
+
 func seed(kv *btree.KV, n int, vlen int) {
-	tx := kv.BeginWrite()
+	tx, err := kv.BeginWrite()
+	check("seed: begin", err)
 	for i := 0; i < n; i++ {
 		k := fmt.Sprintf("k%06d", i)
 		v := make([]byte, vlen)
 		copy(v, []byte(fmt.Sprintf("seed-%d", i)))
-		_ = tx.Set([]byte(k), v)
+		check("seed: set", tx.Set([]byte(k), v))
 	}
-	_ = tx.Commit()
+	check("seed: commit", tx.Commit())
 }
 
 func churn(kv *btree.KV, label string, start, count, vlen int, delEvery int) {
-	tx := kv.BeginWrite()
+	tx, err := kv.BeginWrite()
+	check(label+": begin", err)
 	for i := start; i < start+count; i++ {
 		k := fmt.Sprintf("k%06d", i)
 		if delEvery > 0 && i%delEvery == 0 {
-			_, _ = tx.Del([]byte(k))
+			_, err := tx.Del([]byte(k))
+			check(label+": del", err)
 			continue
 		}
 		doc := map[string]any{"k": k, "v": label, "t": time.Now().UnixNano()}
@@ -45,16 +57,16 @@ func churn(kv *btree.KV, label string, start, count, vlen int, delEvery int) {
 			copy(p, b)
 			b = p
 		}
-		_ = tx.Set([]byte(k), b)
+		check(label+": set", tx.Set([]byte(k), b))
 	}
-	_ = tx.Commit()
+	check(label+": commit", tx.Commit())
 }
 
 func main() {
 	path := filepath.Join(os.TempDir(), fmt.Sprintf("kv_cc_%d.db", time.Now().UnixNano()))
 	var kv btree.KV
 	kv.Path = path
-	_ = kv.Open()
+	check("open", kv.Open())
 	defer kv.Close()
 
 	seed(&kv, 4000, 64)
@@ -23,6 +23,8 @@ type meta struct {
 	headSeq  uint64
 	tailPage uint64
 	tailSeq  uint64
+	seq      uint64
+	pageSize int
 }
 
 func readMeta(path string) (meta, error) {
@@ -31,34 +33,52 @@ func readMeta(path string) (meta, error) {
 		return meta{}, err
 	}
 	defer f.Close()
-	buf := make([]byte, 64)
-	_, err = f.ReadAt(buf, 0)
-	if err != nil {
-		return meta{}, err
+	var best meta
+	found := false
+	for slot := 0; slot < 2; slot++ {
+		buf := make([]byte, btree.META_SIZE)
+		if _, err := f.ReadAt(buf, int64(slot)*btree.META_SLOT_STRIDE); err != nil {
+			continue
+		}
+		if string(buf[:16]) != btree.DB_SIG {
+			continue
+		}
+		m := meta{
+			root:     binary.LittleEndian.Uint64(buf[16:24]),
+			pageUsed: binary.LittleEndian.Uint64(buf[24:32]),
+			headPage: binary.LittleEndian.Uint64(buf[32:40]),
+			headSeq:  binary.LittleEndian.Uint64(buf[40:48]),
+			tailPage: binary.LittleEndian.Uint64(buf[48:56]),
+			tailSeq:  binary.LittleEndian.Uint64(buf[56:64]),
+			seq:      binary.LittleEndian.Uint64(buf[64:72]),
+			pageSize: int(binary.LittleEndian.Uint32(buf[72:76])),
+		}
+		if m.pageSize == 0 {
+			m.pageSize = btree.BTREE_PAGE_SIZE
+		}
+		if !found || m.seq > best.seq {
+			best, found = m, true
+		}
+	}
+	if !found {
+		return meta{}, fmt.Errorf("no meta slot")
 	}
-	return meta{
-		root:     binary.LittleEndian.Uint64(buf[16:24]),
-		pageUsed: binary.LittleEndian.Uint64(buf[24:32]),
-		headPage: binary.LittleEndian.Uint64(buf[32:40]),
-		headSeq:  binary.LittleEndian.Uint64(buf[40:48]),
-		tailPage: binary.LittleEndian.Uint64(buf[48:56]),
-		tailSeq:  binary.LittleEndian.Uint64(buf[56:64]),
-	}, nil
+	return best, nil
 }
 
-func readPage(path string, ptr uint64) []byte {
+func readPage(path string, ptr uint64, pageSize int) []byte {
 	f, err := os.Open(path)
 	must(err)
 	defer f.Close()
-	buf := make([]byte, btree.BTREE_PAGE_SIZE)
-	off := int64(ptr) * int64(btree.BTREE_PAGE_SIZE)
+	buf := make([]byte, pageSize)
+	off := int64(ptr) * int64(pageSize)
 	_, err = f.ReadAt(buf, off)
 	must(err)
 	return buf
 }
 
-func seq2idx(seq uint64) int {
-	return int(seq % btree.FREE_LIST_CAP)
+func seq2idx(seq uint64, pageSize int) int {
+	return int(seq % uint64(btree.FreeListCap(pageSize)))
 }
 
 func collectFreeList(path string, m meta, limit int) []uint64 {
@@ -68,16 +88,16 @@ func collectFreeList(path string, m meta, limit int) []uint64 {
 	var out []uint64
 	page := m.headPage
 	seq := m.headSeq
-	for len(out) < limit && (page != m.tailPage || seq2idx(seq) != seq2idx(m.tailSeq)) {
-		node := readPage(path, page)
-		idx := seq2idx(seq)
+	for len(out) < limit && (page != m.tailPage || seq2idx(seq, m.pageSize) != seq2idx(m.tailSeq, m.pageSize)) {
+		node := readPage(path, page, m.pageSize)
+		idx := seq2idx(seq, m.pageSize)
 		o := btree.FREE_LIST_HEADER + idx*8
 		ptr := binary.LittleEndian.Uint64(node[o : o+8])
 		if ptr != 0 {
 			out = append(out, ptr)
 		}
 		seq++
-		if seq2idx(seq) == 0 {
+		if seq2idx(seq, m.pageSize) == 0 {
 			page = binary.LittleEndian.Uint64(node[:8])
 			if page == 0 {
 				break
@@ -90,10 +110,10 @@ func collectFreeList(path string, m meta, limit int) []uint64 {
 func printSnapshot(title string, kv *btree.KV, keys [][]byte) {
 	fmt.Println("=== ", title, " ===")
 	fi, err := os.Stat(kv.Path)
-	if err == nil && fi.Size() >= 64 {
+	if err == nil && fi.Size() > 0 {
 		m, err := readMeta(kv.Path)
 		if err == nil {
-			fmt.Printf("meta root=%d page_used=%d fl_head=%d@%d fl_tail=%d@%d\n", m.root, m.pageUsed, m.headPage, m.headSeq, m.tailPage, m.tailSeq)
+			fmt.Printf("meta seq=%d page_size=%d root=%d page_used=%d fl_head=%d@%d fl_tail=%d@%d\n", m.seq, m.pageSize, m.root, m.pageUsed, m.headPage, m.headSeq, m.tailPage, m.tailSeq)
 			fl := collectFreeList(kv.Path, m, 24)
 			fmt.Printf("free_list(%d) %v\n", len(fl), fl)
 		} else {
@@ -103,7 +123,8 @@ func printSnapshot(title string, kv *btree.KV, keys [][]byte) {
 		fmt.Println("meta not written yet")
 	}
 	for _, k := range keys {
-		v, ok := kv.Get(k)
+		v, ok, err := kv.Get(k)
+		must(err)
 		if ok {
 			fmt.Printf("get %q -> %q\n", string(k), string(v))
 		} else {
@@ -49,7 +49,8 @@ func main() {
 
 	put := func(pk string, r Row) { b, _ := json.Marshal(r); must(users.Put([]byte(pk), b)) }
 	get := func(pk string) {
-		v, ok := users.Get([]byte(pk))
+		v, ok, err := users.Get([]byte(pk))
+		must(err)
 		if ok {
 			fmt.Println("get", pk, "->", string(v))
 		} else {
@@ -38,7 +38,8 @@ func main() {
 	}
 
 	get := func(pk string) {
-		v, ok := users.Get([]byte(pk))
+		v, ok, err := users.Get([]byte(pk))
+		must(err)
 		if !ok {
 			fmt.Println("get", pk, "-> MISS")
 			return
@@ -48,7 +48,8 @@ func main() {
 	users.CreateIndex("email", emailIndex)
 	users.CreateIndex("age", ageIndex)
 
-	tx := kv.Begin()
+	tx, err := kv.Begin()
+	must(err)
 	{
 		b1, _ := json.Marshal(Row{"Maya", "m@x.com", 21})
 		b2, _ := json.Marshal(Row{"Ali", "a@y.com", 19})
@@ -73,12 +74,15 @@ func main() {
 		return true
 	})
 
-	tx2 := kv.Begin()
+	tx2, err := kv.Begin()
+	must(err)
 	{
 		b1, _ := json.Marshal(Row{"Kai", "k@k.com", 22})
 		must(users.PutTx(tx2, []byte("777"), b1))
-		large := make([]byte, 4001)
-		err := users.PutTx(tx2, []byte("999"), large)
+		// large values go to overflow pages, but a key past the limit fails
+		long := strings.Repeat("9", btree.BTREE_MAX_KEY_SIZE+1)
+		b2, _ := json.Marshal(Row{"Zed", "z@z.com", 30})
+		err := users.PutTx(tx2, []byte(long), b2)
 		if err != nil {
 			tx2.Rollback()
 			fmt.Println("tx2 rolled back")
@@ -6,14 +6,30 @@ import (
 	"go-db/btree"
 )
 
+// reader is what Get and the scans read through: the KV for committed
+// state, or a transaction for its own view.
+type reader interface {
+	Get(key []byte) ([]byte, bool, error)
+	Scan(start, end []byte, fn btree.ScanFn) error
+}
+
 type Table struct {
 	Name string
 	kv   *btree.KV
+	rd   reader
 	idx  map[string]*Index
 }
 
 func NewTable(kv *btree.KV, name string) *Table {
-	return &Table{kv: kv, Name: name, idx: make(map[string]*Index)}
+	return &Table{kv: kv, rd: kv, Name: name, idx: make(map[string]*Index)}
+}
+
+// InTx returns a view of the table whose reads see tx's uncommitted
+// writes. It shares the indexes of t.
+func (t *Table) InTx(tx *btree.Tx) *Table {
+	v := *t
+	v.rd = tx
+	return &v
 }
 
 func (t *Table) CreateIndex(name string, fn KeyFunc) {
@@ -46,54 +62,49 @@ func (t *Table) idxKey(name string, val, pk []byte) []byte {
 	return k
 }
 
+// Put replaces the row and its index entries with one commit. The old
+// row is read in the same write transaction, so that a concurrent Put
+// cannot leave index entries of a row that is gone.
 func (t *Table) Put(pk, row []byte) error {
-	old, ok := t.Get(pk)
-	if ok {
-		for _, ix := range t.idx {
-			for _, v := range ix.fn(old) {
-				_, _ = t.kv.Del(t.idxKey(ix.Name, v, pk))
-			}
-		}
-	}
-	if err := t.kv.Set(t.key(pk), row); err != nil {
+	tx, err := t.kv.BeginWrite()
+	if err != nil {
 		return err
 	}
-	for _, ix := range t.idx {
-		for _, v := range ix.fn(row) {
-			if err := t.kv.Set(t.idxKey(ix.Name, v, pk), nil); err != nil {
-				return err
-			}
-		}
+	if err := t.PutTx(tx, pk, row); err != nil {
+		tx.Rollback()
+		return err
 	}
-	return nil
+	return tx.Commit()
 }
 
-func (t *Table) Get(pk []byte) ([]byte, bool) {
-	return t.kv.Get(t.key(pk))
+func (t *Table) Get(pk []byte) ([]byte, bool, error) {
+	return t.rd.Get(t.key(pk))
 }
 
+// Del deletes the row and its index entries with one commit.
 func (t *Table) Del(pk []byte) (bool, error) {
-	old, ok := t.Get(pk)
-	if ok {
-		for _, ix := range t.idx {
-			for _, v := range ix.fn(old) {
-				_, _ = t.kv.Del(t.idxKey(ix.Name, v, pk))
-			}
-		}
+	tx, err := t.kv.BeginWrite()
+	if err != nil {
+		return false, err
+	}
+	ok, err := t.DelTx(tx, pk)
+	if err != nil || !ok {
+		tx.Rollback()
+		return false, err
 	}
-	return t.kv.Del(t.key(pk))
+	return true, tx.Commit()
 }
 
-func (t *Table) Scan(fn func(pk, val []byte) bool) {
+func (t *Table) Scan(fn func(pk, val []byte) bool) error {
 	start := t.prefix()
 	end := append(append([]byte{}, start...), 0xFF)
-	t.kv.Scan(start, end, func(k, v []byte) bool {
+	return t.rd.Scan(start, end, func(k, v []byte) bool {
 		pk := k[len(start):]
 		return fn(pk, v)
 	})
 }
 
-func (t *Table) ScanRange(startPK, endPK []byte, fn func(pk, val []byte) bool) {
+func (t *Table) ScanRange(startPK, endPK []byte, fn func(pk, val []byte) bool) error {
 	start := t.key(startPK)
 	var end []byte
 	if len(endPK) == 0 {
@@ -102,7 +113,7 @@ func (t *Table) ScanRange(startPK, endPK []byte, fn func(pk, val []byte) bool) {
 	} else {
 		end = t.key(endPK)
 	}
-	t.kv.Scan(start, end, func(k, v []byte) bool {
+	return t.rd.Scan(start, end, func(k, v []byte) bool {
 		pk := k[len(t.prefix()):]
 		if len(endPK) != 0 && bytes.Compare(pk, endPK) >= 0 {
 			return false
@@ -111,17 +122,17 @@ func (t *Table) ScanRange(startPK, endPK []byte, fn func(pk, val []byte) bool) {
 	})
 }
 
-func (t *Table) IndexGet(name string, val []byte, fn func(pk []byte) bool) {
+func (t *Table) IndexGet(name string, val []byte, fn func(pk []byte) bool) error {
 	p := append(t.idxPrefix(name), val...)
 	p = append(p, '|')
 	end := append(append([]byte{}, p...), 0xFF)
-	t.kv.Scan(p, end, func(k, v []byte) bool {
+	return t.rd.Scan(p, end, func(k, v []byte) bool {
 		pk := k[len(p):]
 		return fn(pk)
 	})
 }
 
-func (t *Table) IndexScan(name string, startVal, endVal []byte, fn func(val, pk []byte) bool) {
+func (t *Table) IndexScan(name string, startVal, endVal []byte, fn func(val, pk []byte) bool) error {
 	start := append(t.idxPrefix(name), startVal...)
 	var end []byte
 	if endVal == nil {
@@ -129,7 +140,7 @@ func (t *Table) IndexScan(name string, startVal, endVal []byte, fn func(val, pk
 	} else {
 		end = append(t.idxPrefix(name), endVal...)
 	}
-	t.kv.Scan(start, end, func(k, v []byte) bool {
+	return t.rd.Scan(start, end, func(k, v []byte) bool {
 		rest := k[len(t.idxPrefix(name)):]
 		i := bytes.LastIndexByte(rest, '|')
 		if i < 0 {
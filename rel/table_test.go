@@ -0,0 +1,107 @@
+package rel
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"go-db/btree"
+)
+
+func openTable(t *testing.T) (*btree.KV, *Table) {
+	t.Helper()
+	kv := &btree.KV{Path: filepath.Join(t.TempDir(), "test.db")}
+	if err := kv.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { kv.Close() })
+	tbl := NewTable(kv, "users")
+	tbl.CreateIndex("name", func(row []byte) [][]byte { return [][]byte{row} })
+	return kv, tbl
+}
+
+// checkIndex checks that the index holds one entry per row and nothing
+// else.
+func checkIndex(t *testing.T, tbl *Table) {
+	t.Helper()
+	rows := map[string]string{}
+	if err := tbl.Scan(func(pk, val []byte) bool {
+		rows[string(pk)] = string(val)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	if err := tbl.IndexScan("name", nil, nil, func(val, pk []byte) bool {
+		if rows[string(pk)] != string(val) {
+			t.Errorf("index entry %q for %q, whose row is %q", val, pk, rows[string(pk)])
+		}
+		n++
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != len(rows) {
+		t.Fatalf("%d index entries for %d rows", n, len(rows))
+	}
+}
+
+func TestPutAndDelKeepIndexInStep(t *testing.T) {
+	_, tbl := openTable(t)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				pk := []byte(fmt.Sprint(i % 5))
+				var err error
+				if i%7 == 6 {
+					_, err = tbl.Del(pk)
+				} else {
+					err = tbl.Put(pk, []byte(fmt.Sprintf("name-%d-%d", w, i)))
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	checkIndex(t, tbl)
+}
+
+func TestTableInTx(t *testing.T) {
+	kv, tbl := openTable(t)
+	if err := tbl.Put([]byte("1"), []byte("ann")); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := kv.BeginWrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	view := tbl.InTx(tx)
+	if err := view.PutTx(tx, []byte("1"), []byte("bob")); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, err := view.Get([]byte("1")); err != nil || string(v) != "bob" {
+		t.Fatalf("in the tx: %q %v", v, err)
+	}
+	var pks []string
+	if err := view.IndexGet("name", []byte("bob"), func(pk []byte) bool {
+		pks = append(pks, string(pk))
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(pks) != 1 || pks[0] != "1" {
+		t.Fatalf("index in the tx: %q", pks)
+	}
+	tx.Rollback()
+	if v, _, err := tbl.Get([]byte("1")); err != nil || string(v) != "ann" {
+		t.Fatalf("after rollback: %q %v", v, err)
+	}
+	checkIndex(t, tbl)
+}
@@ -3,7 +3,10 @@ package rel
 import "go-db/btree"
 
 func (t *Table) PutTx(tx *btree.Tx, pk, row []byte) error {
-	old, ok := t.Get(pk)
+	old, ok, err := tx.Get(t.key(pk))
+	if err != nil {
+		return err
+	}
 	if ok {
 		for _, ix := range t.idx {
 			for _, v := range ix.fn(old) {
@@ -27,7 +30,10 @@ func (t *Table) PutTx(tx *btree.Tx, pk, row []byte) error {
 }
 
 func (t *Table) DelTx(tx *btree.Tx, pk []byte) (bool, error) {
-	old, ok := t.Get(pk)
+	old, ok, err := tx.Get(t.key(pk))
+	if err != nil {
+		return false, err
+	}
 	if !ok {
 		return false, nil
 	}
@@ -88,7 +88,10 @@ func (c *Catalog) execOne(s stmt, out func(string)) error {
 		if c.inWrite {
 			return errors.New("tx open")
 		}
-		tx := c.KV.BeginWrite()
+		tx, err := c.KV.BeginWrite()
+		if err != nil {
+			return err
+		}
 		c.inTx = tx
 		c.inWrite = true
 		out("OK")
@@ -125,12 +128,25 @@ func (c *Catalog) execOne(s stmt, out func(string)) error {
 			c.idxfld[s.tbl] = make(map[string]string)
 		}
 		c.idxfld[s.tbl][s.field] = s.idx
-		tx := c.KV.BeginWrite()
-		t.Scan(func(pk, row []byte) bool {
-			_ = t.PutTx(tx, pk, row)
-			return true
+		tx, err := c.KV.BeginWrite()
+		if err != nil {
+			return err
+		}
+		var perr error
+		err = t.Scan(func(pk, row []byte) bool {
+			perr = t.PutTx(tx, pk, row)
+			return perr == nil
 		})
-		_ = tx.Commit()
+		if err == nil {
+			err = perr
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
 		out("OK")
 		return nil
 	case sInsert:
@@ -142,7 +158,10 @@ func (c *Catalog) execOne(s stmt, out func(string)) error {
 		if c.inWrite {
 			return t.PutTx(c.inTx, []byte(s.pk), []byte(s.json))
 		}
-		tx := c.KV.BeginWrite()
+		tx, err := c.KV.BeginWrite()
+		if err != nil {
+			return err
+		}
 		if err := t.PutTx(tx, []byte(s.pk), []byte(s.json)); err != nil {
 			tx.Rollback()
 			return err
@@ -154,8 +173,11 @@ func (c *Catalog) execOne(s stmt, out func(string)) error {
 			_, err := t.DelTx(c.inTx, []byte(s.pk))
 			return err
 		}
-		tx := c.KV.BeginWrite()
-		_, err := t.DelTx(tx, []byte(s.pk))
+		tx, err := c.KV.BeginWrite()
+		if err != nil {
+			return err
+		}
+		_, err = t.DelTx(tx, []byte(s.pk))
 		if err != nil {
 			tx.Rollback()
 			return err
@@ -163,15 +185,21 @@ func (c *Catalog) execOne(s stmt, out func(string)) error {
 		return tx.Commit()
 	case sSelect:
 		t := c.getTable(s.tbl)
+		if c.inWrite {
+			t = t.InTx(c.inTx)
+		}
 		switch s.where {
 		case wNone:
-			t.Scan(func(pk, row []byte) bool {
+			return t.Scan(func(pk, row []byte) bool {
 				out(fmt.Sprintf("%s %s", string(pk), string(row)))
 				return true
 			})
-			return nil
 		case wPkEq:
-			if v, ok := t.Get([]byte(s.pk)); ok {
+			v, ok, err := t.Get([]byte(s.pk))
+			if err != nil {
+				return err
+			}
+			if ok {
 				out(fmt.Sprintf("%s %s", s.pk, string(v)))
 			}
 			return nil
@@ -184,24 +212,32 @@ func (c *Catalog) execOne(s stmt, out func(string)) error {
 			if s.hiInc {
 				end = append([]byte(s.hi), 0)
 			}
-			t.ScanRange(start, end, func(pk, row []byte) bool {
+			return t.ScanRange(start, end, func(pk, row []byte) bool {
 				out(fmt.Sprintf("%s %s", string(pk), string(row)))
 				return true
 			})
-			return nil
 		case wFieldEq:
 			idx := c.idxfld[s.tbl][s.wField]
 			val := jsonFieldIndex(s.wField)([]byte(`{"` + s.wField + `":"` + s.lo + `"}`))
 			if len(val) == 0 {
 				return nil
 			}
-			t.IndexGet(idx, val[0], func(pk []byte) bool {
-				if v, ok := t.Get(pk); ok {
+			var gerr error
+			err := t.IndexGet(idx, val[0], func(pk []byte) bool {
+				v, ok, err := t.Get(pk)
+				if err != nil {
+					gerr = err
+					return false
+				}
+				if ok {
 					out(fmt.Sprintf("%s %s", string(pk), string(v)))
 				}
 				return true
 			})
-			return nil
+			if err != nil {
+				return err
+			}
+			return gerr
 		case wFieldRange:
 			idx := c.idxfld[s.tbl][s.wField]
 			lo := jsonFieldIndex(s.wField)([]byte(`{"` + s.wField + `":"` + s.lo + `"}`))
@@ -217,13 +253,22 @@ func (c *Catalog) execOne(s stmt, out func(string)) error {
 			if s.hiInc {
 				hiKey = append(hiKey, 0)
 			}
-			t.IndexScan(idx, loKey, hiKey, func(_ []byte, pk []byte) bool {
-				if v, ok := t.Get(pk); ok {
+			var gerr error
+			err := t.IndexScan(idx, loKey, hiKey, func(_ []byte, pk []byte) bool {
+				v, ok, err := t.Get(pk)
+				if err != nil {
+					gerr = err
+					return false
+				}
+				if ok {
 					out(fmt.Sprintf("%s %s", string(pk), string(v)))
 				}
 				return true
 			})
-			return nil
+			if err != nil {
+				return err
+			}
+			return gerr
 		}
 	}
 	return errors.New("stmt")